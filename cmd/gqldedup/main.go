@@ -0,0 +1,297 @@
+// Command gqldedup deflate, inflate and inspect captured graphql responses.
+//
+// Usage:
+//
+//	gqldedup <deflate|inflate|normalize|denormalize|stats> [flags] [file...]
+//
+// Every file is processed on its own, stdin is read when no file is given. Output is written to stdout.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/kumparan/gqldeduplicator"
+)
+
+const usage = `usage: gqldedup <deflate|inflate|normalize|denormalize|stats> [flags] [file...]
+
+Commands:
+  deflate      deflate duplicate objects of graphql response
+  inflate      inflate deflated graphql response
+  normalize    move entities of graphql response to entity table
+  denormalize  rebuild normalized graphql response
+  stats        report how much graphql response shrink on deflate
+
+Run gqldedup <command> -h for flags of command.
+`
+
+type (
+	// options hold flags shared by every command
+	options struct {
+		identifiers     string
+		typeIdentifiers multiFlag
+		global          bool
+		globalTypes     multiFlag
+		typenameField   string
+		format          int
+		verbatim        bool
+		response        bool
+		conflict        string
+		minSaving       int
+		minSavingRatio  float64
+	}
+
+	// multiFlag collect every value of repeated flag
+	multiFlag []string
+
+	// command process input of one file and write its result
+	command func(opts []gqldeduplicator.Option, response bool, name string, data []byte, stdout io.Writer) error
+)
+
+var (
+	commands = map[string]command{
+		"deflate":     deflate,
+		"inflate":     inflate,
+		"normalize":   normalize,
+		"denormalize": denormalize,
+		"stats":       stats,
+	}
+
+	conflictPolicies = map[string]gqldeduplicator.ConflictPolicy{
+		"ignore":     gqldeduplicator.ConflictIgnore,
+		"keep-first": gqldeduplicator.ConflictKeepFirst,
+		"keep-both":  gqldeduplicator.ConflictKeepBoth,
+		"fail":       gqldeduplicator.ConflictFail,
+	}
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run run command given by args and return exit code
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "gqldedup: unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+
+	var o options
+	flags := flag.NewFlagSet("gqldedup "+args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&o.identifiers, "identifier", "id", "comma separated fallback identifier fields, the first present field is used")
+	flags.Var(&o.typeIdentifiers, "type-identifier", "composite identifier of typename as Typename=field,field, may be repeated")
+	flags.BoolVar(&o.global, "global", false, "deduplicate every typename across paths")
+	flags.Var(&o.globalTypes, "global-type", "deduplicate typename across paths, may be repeated")
+	flags.StringVar(&o.typenameField, "typename-field", "__typename", "typename field")
+	flags.IntVar(&o.format, "format", 1, "wire format version: 1 for plain stubs, 2 for stubs marked by "+gqldeduplicator.Marker)
+	flags.BoolVar(&o.verbatim, "verbatim", false, "keep input as is, only change deflated or inflated objects")
+	flags.BoolVar(&o.response, "response", false, "treat input as complete graphql response and only process its data")
+	flags.StringVar(&o.conflict, "conflict", "ignore", "conflict policy: ignore, keep-first, keep-both or fail")
+	flags.IntVar(&o.minSaving, "min-saving", 0, "keep input as is when deflating saves less bytes")
+	flags.Float64Var(&o.minSavingRatio, "min-saving-ratio", 0, "keep input as is when deflating saves less ratio of output, between 0 and 1")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	opts, err := o.build()
+	if err != nil {
+		fmt.Fprintf(stderr, "gqldedup: %v\n", err)
+		return 2
+	}
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		data, err := readFile(name, stdin)
+		if err == nil {
+			err = cmd(opts, o.response, name, data, stdout)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "gqldedup: %s: %v\n", name, err)
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// build convert flags into deflater and inflater options
+func (o *options) build() ([]gqldeduplicator.Option, error) {
+	opts := []gqldeduplicator.Option{
+		gqldeduplicator.WithIdentifier(strings.Split(o.identifiers, ",")...),
+		gqldeduplicator.WithTypenameField(o.typenameField),
+	}
+	for _, value := range o.typeIdentifiers {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid type identifier %q, expecting Typename=field,field", value)
+		}
+		opts = append(opts, gqldeduplicator.WithTypeIdentifier(parts[0], strings.Split(parts[1], ",")...))
+	}
+	if o.global {
+		opts = append(opts, gqldeduplicator.WithGlobalIdentity())
+	}
+	if len(o.globalTypes) > 0 {
+		opts = append(opts, gqldeduplicator.WithGlobalType(o.globalTypes...))
+	}
+	if o.format != int(gqldeduplicator.FormatImplicit) && o.format != int(gqldeduplicator.FormatMarked) {
+		return nil, fmt.Errorf("unknown format %d", o.format)
+	}
+	opts = append(opts, gqldeduplicator.WithFormat(gqldeduplicator.Format(o.format)))
+	if o.verbatim {
+		opts = append(opts, gqldeduplicator.WithVerbatimOutput())
+	}
+	if o.minSaving > 0 {
+		opts = append(opts, gqldeduplicator.WithMinSaving(o.minSaving))
+	}
+	if o.minSavingRatio > 0 {
+		opts = append(opts, gqldeduplicator.WithMinSavingRatio(o.minSavingRatio))
+	}
+
+	policy, ok := conflictPolicies[o.conflict]
+	if !ok {
+		return nil, fmt.Errorf("unknown conflict policy %q", o.conflict)
+	}
+	opts = append(opts, gqldeduplicator.WithConflictPolicy(policy))
+
+	return opts, nil
+}
+
+// String return values joined by space
+func (f *multiFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+// Set append value
+func (f *multiFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func readFile(name string, stdin io.Reader) ([]byte, error) {
+	if name == "-" {
+		return ioutil.ReadAll(stdin)
+	}
+	return ioutil.ReadFile(name)
+}
+
+func deflate(opts []gqldeduplicator.Option, response bool, name string, data []byte, stdout io.Writer) error {
+	result, err := deflateWith(opts, response, data)
+	if err != nil {
+		return err
+	}
+
+	return writeLine(stdout, result.Data)
+}
+
+func inflate(opts []gqldeduplicator.Option, response bool, name string, data []byte, stdout io.Writer) error {
+	inflater := gqldeduplicator.NewInflater(opts...)
+	inflateFunc := inflater.Inflate
+	if response {
+		inflateFunc = inflater.InflateResponse
+	}
+
+	result, err := inflateFunc(data)
+	if err != nil {
+		return err
+	}
+
+	return writeLine(stdout, result.Data)
+}
+
+func normalize(opts []gqldeduplicator.Option, response bool, name string, data []byte, stdout io.Writer) error {
+	result, err := gqldeduplicator.NewDeflater(opts...).Normalize(data)
+	if err != nil {
+		return err
+	}
+
+	return writeLine(stdout, result.Data)
+}
+
+func denormalize(opts []gqldeduplicator.Option, response bool, name string, data []byte, stdout io.Writer) error {
+	result, err := gqldeduplicator.NewInflater(opts...).Denormalize(data)
+	if err != nil {
+		return err
+	}
+
+	return writeLine(stdout, result.Data)
+}
+
+func stats(opts []gqldeduplicator.Option, response bool, name string, data []byte, stdout io.Writer) error {
+	result, err := deflateWith(opts, response, data)
+	if err != nil {
+		return err
+	}
+
+	// baseline is the same input encoded the same way without any entity deduplicated,
+	// so compacting whitespace does not count as saving
+	baseline, err := deflateWith(append(opts[:len(opts):len(opts)], gqldeduplicator.WithRule(func(gqldeduplicator.Entity) bool {
+		return false
+	})), response, data)
+	if err != nil {
+		return err
+	}
+
+	stats := result.Stats
+	base := baseline.Stats.OutputSize
+	saving := 0.0
+	if base > 0 {
+		saving = 100 * (1 - float64(stats.OutputSize)/float64(base))
+	}
+	fmt.Fprintf(stdout, "%s: %d -> %d bytes, %d without deduplication (%.1f%% saved), %d stubs, %d conflicts\n",
+		name, stats.InputSize, stats.OutputSize, base, saving, stats.Stubs, len(result.Conflicts))
+	writeCounts(stdout, "by typename", stats.ByTypename)
+	writeCounts(stdout, "by path", stats.ByPath)
+
+	return nil
+}
+
+// deflateWith deflate data, or whole response when response is set, using opts
+func deflateWith(opts []gqldeduplicator.Option, response bool, data []byte) (*gqldeduplicator.DeflateResult, error) {
+	deflater := gqldeduplicator.NewDeflater(opts...)
+	if response {
+		return deflater.DeflateResponse(data)
+	}
+	return deflater.Deflate(data)
+}
+
+// writeCounts write counts sorted by name under title, nothing is written without count
+func writeCounts(w io.Writer, title string, counts map[string]int) {
+	if len(counts) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "  %s:\n", title)
+	for _, name := range names {
+		fmt.Fprintf(w, "    %s: %d\n", name, counts[name])
+	}
+}
+
+func writeLine(w io.Writer, data []byte) error {
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
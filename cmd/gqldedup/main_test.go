@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	full := `{"root":[{"__typename":"foo","uuid":1,"name":"foo"},{"__typename":"foo","uuid":1,"name":"foo"},{"__typename":"bar","a":1,"b":2},{"__typename":"bar","a":1,"b":2}]}`
+	deflated := `{"root":[{"__typename":"foo","uuid":1,"name":"foo"},{"__typename":"foo","uuid":1},{"__typename":"bar","a":1,"b":2},{"__typename":"bar","a":1,"b":2}]}`
+
+	tests := []struct {
+		Name     string
+		Args     []string
+		Stdin    string
+		Expected string
+		Code     int
+	}{
+		{
+			Name:     "should deflate stdin",
+			Args:     []string{"deflate", "-identifier", "id,uuid"},
+			Stdin:    full,
+			Expected: deflated + "\n",
+		},
+		{
+			Name:     "should deflate with type identifier",
+			Args:     []string{"deflate", "-identifier", "uuid", "-type-identifier", "bar=a,b"},
+			Stdin:    full,
+			Expected: `{"root":[{"__typename":"foo","uuid":1,"name":"foo"},{"__typename":"foo","uuid":1},{"__typename":"bar","a":1,"b":2},{"__typename":"bar","a":1,"b":2}]}` + "\n",
+		},
+		{
+			Name:     "should deflate global type across paths",
+			Args:     []string{"deflate", "-global-type", "foo"},
+			Stdin:    `{"a":{"__typename":"foo","id":1,"name":"foo"},"b":{"__typename":"foo","id":1,"name":"foo"}}`,
+			Expected: `{"a":{"__typename":"foo","id":1,"name":"foo"},"b":{"__typename":"foo","id":1}}` + "\n",
+		},
+		{
+			Name:     "should keep input below minimum saving",
+			Args:     []string{"deflate", "-identifier", "uuid", "-min-saving", "100"},
+			Stdin:    full,
+			Expected: full + "\n",
+		},
+		{
+			Name:     "should inflate stdin",
+			Args:     []string{"inflate", "-identifier", "uuid", "-"},
+			Stdin:    deflated,
+			Expected: full + "\n",
+		},
+		{
+			Name:     "should inflate marked stub",
+			Args:     []string{"inflate", "-format", "2"},
+			Stdin:    `{"root":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"__deflated":true},{"__typename":"foo","id":1}]}`,
+			Expected: `{"root":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1}]}` + "\n",
+		},
+		{
+			Name:     "should normalize stdin",
+			Args:     []string{"normalize"},
+			Stdin:    `{"a":{"__typename":"foo","id":1,"name":"foo"}}`,
+			Expected: `{"result":{"a":{"__typename":"foo","id":1}},"entities":{"foo":{"1":{"__typename":"foo","id":1,"name":"foo"}}}}` + "\n",
+		},
+		{
+			Name:     "should denormalize stdin",
+			Args:     []string{"denormalize"},
+			Stdin:    `{"result":{"a":{"__typename":"foo","id":1}},"entities":{"foo":{"1":{"__typename":"foo","id":1,"name":"foo"}}}}`,
+			Expected: `{"a":{"__typename":"foo","id":1,"name":"foo"}}` + "\n",
+		},
+		{
+			Name:     "should deflate data of response",
+			Args:     []string{"deflate", "-response"},
+			Stdin:    `{"data":[{"__typename":"foo","id":1},{"__typename":"foo","id":1}]}`,
+			Expected: `{"data":[{"__typename":"foo","id":1},{"__typename":"foo","id":1}],"extensions":{"deduplicator":{"deflated":true}}}` + "\n",
+		},
+		{
+			Name:     "should report stats",
+			Args:     []string{"stats", "-identifier", "uuid", "-type-identifier", "bar=a,b"},
+			Stdin:    full,
+			Expected: "-: 162 -> 149 bytes, 162 without deduplication (8.0% saved), 2 stubs, 0 conflicts\n  by typename:\n    bar: 1\n    foo: 1\n  by path:\n    root: 2\n",
+		},
+		{
+			Name:     "should not count compacted whitespace as saved",
+			Args:     []string{"stats"},
+			Stdin:    "{ \"a\" : { \"__typename\" : \"foo\", \"id\" : 1 } }",
+			Expected: "-: 44 -> 33 bytes, 33 without deduplication (0.0% saved), 0 stubs, 0 conflicts\n",
+		},
+		{
+			Name: "should fail without command",
+			Code: 2,
+		},
+		{
+			Name: "should fail on unknown command",
+			Args: []string{"compress"},
+			Code: 2,
+		},
+		{
+			Name: "should fail on invalid type identifier",
+			Args: []string{"deflate", "-type-identifier", "bar"},
+			Code: 2,
+		},
+		{
+			Name: "should fail on unknown format",
+			Args: []string{"deflate", "-format", "3"},
+			Code: 2,
+		},
+		{
+			Name: "should fail on unknown conflict policy",
+			Args: []string{"deflate", "-conflict", "merge"},
+			Code: 2,
+		},
+		{
+			Name:  "should fail on invalid json",
+			Args:  []string{"deflate"},
+			Stdin: `{`,
+			Code:  1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := run(test.Args, strings.NewReader(test.Stdin), &stdout, &stderr)
+			assert.Equal(t, test.Code, code, stderr.String())
+			assert.Equal(t, test.Expected, stdout.String())
+			if test.Code != 0 {
+				assert.NotEmpty(t, stderr.String())
+			}
+		})
+	}
+
+	t.Run("should process every file", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "gqldedup")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		first, second := filepath.Join(dir, "first.json"), filepath.Join(dir, "second.json")
+		assert.NoError(t, ioutil.WriteFile(first, []byte(full), 0600))
+		assert.NoError(t, ioutil.WriteFile(second, []byte(`{}`), 0600))
+
+		var stdout, stderr bytes.Buffer
+		code := run([]string{"deflate", "-identifier", "uuid", first, second}, strings.NewReader(""), &stdout, &stderr)
+		assert.Equal(t, 0, code, stderr.String())
+		assert.Equal(t, deflated+"\n{}\n", stdout.String())
+
+		code = run([]string{"deflate", filepath.Join(dir, "missing.json")}, strings.NewReader(""), &stdout, &stderr)
+		assert.Equal(t, 1, code)
+	})
+}
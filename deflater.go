@@ -1,101 +1,336 @@
 package gqldeduplicator
 
-import (
-	"encoding/json"
-	"fmt"
+const (
+	// ConflictIgnore deflate duplicate entity without comparing its field values
+	ConflictIgnore ConflictPolicy = iota
+	// ConflictKeepFirst deflate duplicate entity and report conflict, inflate restore values of the first occurrence
+	ConflictKeepFirst
+	// ConflictKeepBoth keep duplicate entity in full and report conflict
+	ConflictKeepBoth
+	// ConflictFail abort deflate with *ConflictError
+	ConflictFail
 )
 
-const deflatedKey = "__deflated_key__"
-
 type (
-	// DeflateResult represent deflated object result
+	// DeflateResult represent deflated object result, Conflicts is only reported when conflict policy is set
 	DeflateResult struct {
-		Data     []byte
-		Deflated bool
+		Data      []byte
+		Deflated  bool
+		Conflicts []Conflict
+		Stats     Stats
+	}
+
+	// DeflateValueResult represent deflated value result, Conflicts is only reported when conflict policy is set
+	DeflateValueResult struct {
+		Value     interface{}
+		Deflated  bool
+		Conflicts []Conflict
+		Stats     Stats
+	}
+
+	// Stats represent deflate savings, sizes are in bytes and are not reported for deflated value.
+	// ByTypename and ByPath break Stubs down by typename and by path joined by dot, they are nil without stub.
+	Stats struct {
+		InputSize  int
+		OutputSize int
+		Stubs      int
+		ByTypename map[string]int
+		ByPath     map[string]int
+	}
+
+	// ConflictPolicy decide what to do with duplicate entity whose field values differ from the first occurrence
+	ConflictPolicy int
+
+	// Conflict represent duplicate entity with Fields whose values differ from the first occurrence
+	Conflict struct {
+		Entity
+		Fields []string
+	}
+
+	// Deflater deflate graphql response with its options, it is safe for concurrent use
+	Deflater struct {
+		config config
+	}
+
+	deflateState struct {
+		config    *config
+		memoize   map[string]fingerprint
+		hashes    hashCache
+		paths     map[int]bool
+		edits     []edit
+		conflicts []Conflict
+		deflated  bool
+		stats     Stats
+		// replaced count objects replaced by stub, a subtree is changed when it grows while walking it
+		replaced int
+		// order hold memoize order of entities of global typename and stubbed their keys replaced by stub,
+		// both are only tracked by stream
+		order   map[string]int
+		stubbed map[string]bool
 	}
 )
 
+var defaultDeflater = NewDeflater()
+
+// NewDeflater create deflater, identifier is id and typename field is __typename unless set by options
+func NewDeflater(opts ...Option) *Deflater {
+	return &Deflater{config: newConfig(opts)}
+}
+
 // Deflate deflate similar object in graphql response by id as default identifier.
-// Use deep first search (DFS) algorithm to walk over nodes and memoize object.
-// If object appeared or memoized before, then it will deflated.
+// Use deep first search (DFS) algorithm to walk over nodes in document order and memoize object.
+// If object appeared or memoized before, then it will deflated, so the first occurrence is always kept in full.
 func Deflate(data []byte) (*DeflateResult, error) {
-	var node interface{}
-	err := json.Unmarshal(data, &node)
-	if err != nil {
+	return defaultDeflater.Deflate(data)
+}
+
+// DeflateWithCustomIdentifier deflate similar object in graphql response by identifier.
+// Use deep first search (DFS) algorithm to walk over nodes in document order and memoize object.
+// If object appeared or memoized before, then it will deflated, so the first occurrence is always kept in full.
+//
+// Deprecated: use NewDeflater(WithIdentifier(identifier)).Deflate(data) instead.
+func DeflateWithCustomIdentifier(data []byte, identifier string) (*DeflateResult, error) {
+	return NewDeflater(WithIdentifier(identifier)).Deflate(data)
+}
+
+// Deflate deflate similar object in graphql response using deflater options.
+// Use deep first search (DFS) algorithm to walk over nodes in document order and memoize object.
+// If object appeared or memoized before, then it will deflated, so the first occurrence is always kept in full.
+// Object is only deflated when it has the same fields as the memoized one, otherwise it is kept in full.
+// Document is scanned in place instead of decoded, so strings and numbers are copied exactly as written.
+// When stubs save less than WithMinSaving or WithMinSavingRatio, data is returned as is with Deflated false.
+func (d *Deflater) Deflate(data []byte) (*DeflateResult, error) {
+	if err := d.config.validate(data, d.config.maxDepth); err != nil {
 		return nil, err
 	}
 
-	memoize := make(map[string]bool)
-	resultByte, err := json.Marshal(deflate(node, memoize, "id", ""))
-	if err != nil {
+	return d.deflate(data)
+}
+
+// withFormat return deflater using format, the deflater itself when it already does
+func (d *Deflater) withFormat(format Format) *Deflater {
+	if format == d.config.format {
+		return d
+	}
+
+	deflater := *d
+	deflater.config.format = format
+	return &deflater
+}
+
+// deflate deflate validated data
+func (d *Deflater) deflate(data []byte) (*DeflateResult, error) {
+	state := newScanDeflater(&d.config, data)
+	if err := state.run(); err != nil {
 		return nil, err
 	}
 
+	if state.deflated && !state.config.worthSaving(state.saved, len(state.out)+state.saved) {
+		return &DeflateResult{Data: data, Stats: Stats{InputSize: len(data), OutputSize: len(data)}}, nil
+	}
+
+	state.stats.InputSize, state.stats.OutputSize = len(data), len(state.out)
 	return &DeflateResult{
-		Data:     resultByte,
-		Deflated: memoize[deflatedKey],
+		Data:      state.out,
+		Deflated:  state.deflated,
+		Conflicts: state.conflicts,
+		Stats:     state.stats,
 	}, nil
 }
 
-// DeflateWithCustomIdentifier deflate similar object in graphql response by identifier.
-// Use deep first search (DFS) algorithm to walk over nodes and memoize object.
-// If object appeared or memoized before, then it will deflated.
-func DeflateWithCustomIdentifier(data []byte, identifier string) (*DeflateResult, error) {
-	var node interface{}
-	err := json.Unmarshal(data, &node)
-	if err != nil {
+// DeflateValue deflate similar object in graphql response already decoded by encoding/json into interface{}.
+// See Deflater.DeflateValue.
+func DeflateValue(v interface{}) (*DeflateValueResult, error) {
+	return defaultDeflater.DeflateValue(v)
+}
+
+// DeflateValue deflate similar object in value made of map[string]interface{}, []interface{} and scalars,
+// as decoded by encoding/json. Since maps are unordered, members are walked in sorted key order.
+// Maps and lists of v are modified in place and stubs are new maps, unless WithCopyOnWrite is set,
+// then v is left untouched and only maps and lists on the way to a stub are copied.
+func (d *Deflater) DeflateValue(v interface{}) (*DeflateValueResult, error) {
+	if err := checkDepth(v, d.config.maxDepth); err != nil {
 		return nil, err
 	}
 
-	memoize := make(map[string]bool)
-	resultByte, err := json.Marshal(deflate(node, memoize, identifier, ""))
+	config := d.config
+	config.verbatim = false
+	state := &deflateState{
+		config:  &config,
+		memoize: make(map[string]fingerprint),
+		hashes:  make(hashCache),
+	}
+	value, err := state.deflate(v, newPath())
 	if err != nil {
 		return nil, err
 	}
 
-	return &DeflateResult{
-		Data:     resultByte,
-		Deflated: memoize[deflatedKey],
+	return &DeflateValueResult{
+		Value:     value,
+		Deflated:  state.deflated,
+		Conflicts: state.conflicts,
+		Stats:     state.stats,
 	}, nil
 }
 
-func deflate(node interface{}, memoize map[string]bool, identifier, path string) interface{} {
+func (s *deflateState) deflate(node interface{}, path *pathNode) (interface{}, error) {
 	switch value := node.(type) {
 	case []interface{}:
-		for i, v := range value {
-			switch v.(type) {
-			case []interface{}, map[string]interface{}:
-				value[i] = deflate(v, memoize, identifier, path)
-			default:
-				value[i] = v
-			}
-		}
-		return value
+		return s.deflateList(value, path)
+	case *object:
+		return s.deflateObject(value, path)
 	case map[string]interface{}:
-		if value != nil && value[identifier] != nil && value["__typename"] != nil {
-			key := fmt.Sprintf("%s,%v,%v", path, value["__typename"], value[identifier])
-			if memoize[key] {
-				memoize[deflatedKey] = true
-				return map[string]interface{}{
-					identifier:   value[identifier],
-					"__typename": value["__typename"],
+		deflated, err := s.deflateObject(mapObject(value), path)
+		if err != nil {
+			return nil, err
+		}
+		return deflated.values, nil
+	}
+
+	return node, nil
+}
+
+func (s *deflateState) deflateList(value []interface{}, path *pathNode) ([]interface{}, error) {
+	copied := false
+	for i, v := range value {
+		if !isContainer(v) {
+			continue
+		}
+
+		replaced := s.replaced
+		child, err := s.deflate(v, path)
+		if err != nil {
+			return nil, err
+		}
+		if s.replaced == replaced {
+			continue
+		}
+		if s.config.copyOnWrite && !copied {
+			value, copied = append([]interface{}(nil), value...), true
+		}
+		value[i] = child
+	}
+
+	return value, nil
+}
+
+func (s *deflateState) deflateObject(value *object, path *pathNode) (*object, error) {
+	if entity, ok := s.config.entity(value, path); ok {
+		key, err := s.config.key(entity, path)
+		if err != nil {
+			return nil, err
+		}
+		if memoized, found := s.memoize[key]; found {
+			deflatable, err := s.deflatable(entity, path, memoized, newFingerprint(value, s.hashes), value.keys)
+			if err != nil {
+				return nil, err
+			}
+			if deflatable {
+				if s.stubbed != nil {
+					s.stubbed[key] = true
 				}
+				s.countStub(entity.Typename, path)
+				stub := s.config.stub(entity)
+				if s.config.verbatim {
+					s.edits = append(s.edits, edit{start: value.start, end: value.end, value: stub})
+				}
+				s.replaced++
+				return stub, nil
 			}
+		} else if err := s.memoizeEntity(entity.Typename, key, newFingerprint(value, s.hashes), path); err != nil {
+			return nil, err
+		}
+	}
 
-			memoize[key] = true
+	copied := false
+	for _, k := range value.keys {
+		v := value.values[k]
+		if !isContainer(v) {
+			continue
 		}
 
-		for k, v := range value {
-			switch v.(type) {
-			case []interface{}, map[string]interface{}:
-				value[k] = deflate(v, memoize, identifier, path+","+k)
-			default:
-				value[k] = v
-			}
+		replaced := s.replaced
+		child, err := s.deflate(v, path.child(k))
+		if err != nil {
+			return nil, err
+		}
+		if s.replaced == replaced {
+			continue
 		}
+		if s.config.copyOnWrite && !copied {
+			value, copied = value.clone(), true
+		}
+		value.values[k] = child
+	}
+
+	return value, nil
+}
+
+// memoizeEntity memoize fields of the first occurrence of entity of typename, and its path when paths are tracked.
+// Path of entity of global typename is not tracked, as it may be duplicated at any path.
+func (s *deflateState) memoizeEntity(typename, key string, fields fingerprint, path *pathNode) error {
+	if err := s.config.checkEntities(len(s.memoize) + 1); err != nil {
+		return err
+	}
+
+	s.memoize[key] = fields
+	if s.paths != nil && !s.config.isGlobal(typename) {
+		s.paths[path.id] = true
+	}
+	if s.order != nil && s.config.isGlobal(typename) {
+		s.order[key] = len(s.memoize)
+	}
+	return nil
+}
+
+// countStub count stub of typename at path in stats
+func (s *deflateState) countStub(typename string, path *pathNode) {
+	if s.stats.Stubs == 0 {
+		s.stats.ByTypename = make(map[string]int)
+		s.stats.ByPath = make(map[string]int)
+	}
+	s.stats.Stubs++
+	s.stats.ByTypename[typename]++
+	s.stats.ByPath[path.String()]++
+}
+
+// deflatable report whether duplicate entity at path with fields named by names may be replaced by stub
+func (s *deflateState) deflatable(entity Entity, path *pathNode, memoized, fields fingerprint, names []string) (bool, error) {
+	if !memoized.sameSelection(fields) {
+		return false, nil
+	}
+
+	ok, err := s.resolveConflict(entity, path, memoized, fields, names)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	s.deflated = true
+	s.config.notify(entity, path)
+	return true, nil
+}
+
+// resolveConflict compare field values of duplicate entity with the memoized one when conflict policy is set,
+// it report whether the duplicate may be deflated
+func (s *deflateState) resolveConflict(entity Entity, path *pathNode, memoized, fields fingerprint, keys []string) (bool, error) {
+	if s.config.conflictPolicy == ConflictIgnore {
+		return true, nil
+	}
+
+	differ := memoized.diff(fields, keys)
+	if len(differ) == 0 {
+		return true, nil
+	}
 
-		return value
+	conflict := Conflict{Entity: entity.at(path), Fields: differ}
+	switch s.config.conflictPolicy {
+	case ConflictKeepBoth:
+		s.conflicts = append(s.conflicts, conflict)
+		return false, nil
+	case ConflictFail:
+		return false, &ConflictError{Conflict: conflict}
 	}
 
-	return node
+	s.conflicts = append(s.conflicts, conflict)
+	return true, nil
 }
@@ -1,6 +1,11 @@
 package gqldeduplicator
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -734,3 +739,516 @@ func TestDeflateIdentifier(t *testing.T) {
 		assert.Nil(t, result)
 	})
 }
+
+func TestDeflateDocumentOrder(t *testing.T) {
+	given := []byte(`{"root":[{"name":"foo","id":1,"__typename":"foo","zeta":true,"alpha":false},{"__typename":"foo","id":1,"name":"foo","zeta":true,"alpha":false}]}`)
+	expected := `{"root":[{"name":"foo","id":1,"__typename":"foo","zeta":true,"alpha":false},{"__typename":"foo","id":1}]}`
+
+	t.Run("should keep document key order and produce stable output", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			result, err := Deflate(given)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, string(result.Data))
+		}
+	})
+}
+
+func TestDeflater(t *testing.T) {
+	given := []byte(`
+	{
+		"root": [
+			{
+				"kind": "foo",
+				"uuid": 1,
+				"name": "foo"
+			},
+			{
+				"kind": "foo",
+				"uuid": 1,
+				"name": "foo"
+			},
+			{
+				"kind": "bar",
+				"uuid": 1,
+				"name": "bar"
+			},
+			{
+				"kind": "bar",
+				"uuid": 1,
+				"name": "bar"
+			}
+		]
+	}`)
+
+	t.Run("should deflate with custom typename field and identifier", func(t *testing.T) {
+		var hooked []Entity
+		deflater := NewDeflater(
+			WithIdentifier("uuid"),
+			WithTypenameField("kind"),
+			WithHook(func(entity Entity) {
+				hooked = append(hooked, entity)
+			}),
+		)
+
+		result, err := deflater.Deflate(given)
+		assert.NoError(t, err)
+		assert.True(t, result.Deflated)
+		assert.JSONEq(t, `
+		{
+			"root": [
+				{"kind": "foo", "uuid": 1, "name": "foo"},
+				{"kind": "foo", "uuid": 1},
+				{"kind": "bar", "uuid": 1, "name": "bar"},
+				{"kind": "bar", "uuid": 1}
+			]
+		}`, string(result.Data))
+		assert.Equal(t, []Entity{
+			{Path: Path{"root"}, Typename: "foo", Identifiers: []string{"uuid"}, ID: []interface{}{json.Number("1")}},
+			{Path: Path{"root"}, Typename: "bar", Identifiers: []string{"uuid"}, ID: []interface{}{json.Number("1")}},
+		}, hooked)
+	})
+
+	t.Run("should only deflate entity allowed by rules", func(t *testing.T) {
+		deflater := NewDeflater(
+			WithIdentifier("uuid"),
+			WithTypenameField("kind"),
+			WithRule(func(entity Entity) bool {
+				return entity.Typename != "foo"
+			}),
+		)
+
+		result, err := deflater.Deflate(given)
+		assert.NoError(t, err)
+		assert.True(t, result.Deflated)
+		assert.JSONEq(t, `
+		{
+			"root": [
+				{"kind": "foo", "uuid": 1, "name": "foo"},
+				{"kind": "foo", "uuid": 1, "name": "foo"},
+				{"kind": "bar", "uuid": 1, "name": "bar"},
+				{"kind": "bar", "uuid": 1}
+			]
+		}`, string(result.Data))
+	})
+
+	t.Run("should deflate by per type identifier and composite key", func(t *testing.T) {
+		deflater := NewDeflater(
+			WithIdentifier("id", "uuid"),
+			WithTypeIdentifier("Repo", "orgId", "slug"),
+		)
+
+		result, err := deflater.Deflate([]byte(`
+		{
+			"root": [
+				{"__typename": "User", "id": 1, "name": "foo"},
+				{"__typename": "User", "id": 1, "name": "foo"},
+				{"__typename": "Token", "uuid": "a", "name": "foo"},
+				{"__typename": "Token", "uuid": "a", "name": "foo"},
+				{"__typename": "Repo", "id": 1, "orgId": 1, "slug": "foo", "name": "foo"},
+				{"__typename": "Repo", "id": 1, "orgId": 2, "slug": "foo", "name": "foo"},
+				{"__typename": "Repo", "id": 2, "orgId": 1, "slug": "foo", "name": "foo"},
+				{"__typename": "Repo", "id": 3, "slug": "foo", "name": "foo"},
+				{"__typename": "Repo", "id": 3, "slug": "foo", "name": "foo"}
+			]
+		}`))
+		assert.NoError(t, err)
+		assert.True(t, result.Deflated)
+		assert.JSONEq(t, `
+		{
+			"root": [
+				{"__typename": "User", "id": 1, "name": "foo"},
+				{"__typename": "User", "id": 1},
+				{"__typename": "Token", "uuid": "a", "name": "foo"},
+				{"__typename": "Token", "uuid": "a"},
+				{"__typename": "Repo", "id": 1, "orgId": 1, "slug": "foo", "name": "foo"},
+				{"__typename": "Repo", "id": 1, "orgId": 2, "slug": "foo", "name": "foo"},
+				{"__typename": "Repo", "orgId": 1, "slug": "foo"},
+				{"__typename": "Repo", "id": 3, "slug": "foo", "name": "foo"},
+				{"__typename": "Repo", "id": 3, "slug": "foo", "name": "foo"}
+			]
+		}`, string(result.Data))
+	})
+
+	t.Run("should be safe for concurrent use", func(t *testing.T) {
+		deflater := NewDeflater(WithIdentifier("uuid"), WithTypenameField("kind"))
+		expected, err := deflater.Deflate(given)
+		assert.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				result, err := deflater.Deflate(given)
+				assert.NoError(t, err)
+				assert.Equal(t, string(expected.Data), string(result.Data))
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func TestDeflateDistinctKeys(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Given string
+	}{
+		{
+			Name:  "should not deflate string and number identifier with same text",
+			Given: `{"root":[{"__typename":"foo","id":"1","name":"foo"},{"__typename":"foo","id":1,"name":"foo"}]}`,
+		},
+		{
+			Name:  "should not deflate field name containing comma",
+			Given: `{"a,b":{"__typename":"foo","id":1,"name":"foo"},"a":{"b":{"__typename":"foo","id":1,"name":"foo"}}}`,
+		},
+		{
+			Name:  "should not deflate typename containing comma",
+			Given: `{"root":[{"__typename":"foo,1","id":2,"name":"foo"},{"__typename":"foo","id":"1,2","name":"foo"}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			result, err := Deflate([]byte(test.Given))
+			assert.NoError(t, err)
+			assert.JSONEq(t, test.Given, string(result.Data))
+			assert.False(t, result.Deflated)
+		})
+	}
+}
+
+func TestDeflateNumbers(t *testing.T) {
+	t.Run("should not deflate large identifiers that differ beyond float precision", func(t *testing.T) {
+		given := `{"root":[{"__typename":"foo","id":9007199254740993,"name":"foo"},{"__typename":"foo","id":9007199254740992,"name":"foo"}]}`
+
+		result, err := Deflate([]byte(given))
+		assert.NoError(t, err)
+		assert.Equal(t, given, string(result.Data))
+		assert.False(t, result.Deflated)
+	})
+
+	t.Run("should keep numbers exactly as written", func(t *testing.T) {
+		result, err := Deflate([]byte(`{"root":[{"__typename":"foo","id":12345678901234567890,"price":1.50,"big":1e400,"small":-0.0},{"__typename":"foo","id":12345678901234567890,"price":1.50,"big":1e400,"small":-0.0}]}`))
+		assert.NoError(t, err)
+		assert.Equal(t, `{"root":[{"__typename":"foo","id":12345678901234567890,"price":1.50,"big":1e400,"small":-0.0},{"__typename":"foo","id":12345678901234567890}]}`, string(result.Data))
+		assert.True(t, result.Deflated)
+	})
+}
+
+func TestDeflateVerbatimOutput(t *testing.T) {
+	given := `{
+	"zeta": "<b>café &amp;</b>",
+	"root": [
+		{"__typename": "foo", "id": 1, "price": 1.50, "url": "a\/b"},
+		{
+			"__typename": "foo",
+			"id": 1,
+			"price": 1.50,
+			"url": "a\/b"
+		}
+	],
+	"alpha": [ 1e3, true, null ]
+}
+`
+	expected := `{
+	"zeta": "<b>café &amp;</b>",
+	"root": [
+		{"__typename": "foo", "id": 1, "price": 1.50, "url": "a\/b"},
+		{"__typename":"foo","id":1}
+	],
+	"alpha": [ 1e3, true, null ]
+}
+`
+
+	t.Run("should only change deflated object", func(t *testing.T) {
+		result, err := NewDeflater(WithVerbatimOutput()).Deflate([]byte(given))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(result.Data))
+		assert.True(t, result.Deflated)
+	})
+
+	t.Run("should copy input without duplicates as is", func(t *testing.T) {
+		given := "{\n  \"b\": \"<&>\",\n  \"a\": 1.0\n}"
+		result, err := NewDeflater(WithVerbatimOutput()).Deflate([]byte(given))
+		assert.NoError(t, err)
+		assert.Equal(t, given, string(result.Data))
+		assert.False(t, result.Deflated)
+	})
+}
+
+func TestDeflateSelection(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Given    string
+		Expected string
+		Deflated bool
+	}{
+		{
+			Name:     "should not deflate duplicate with extra field",
+			Given:    `{"root":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"foo","age":1}]}`,
+			Expected: `{"root":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"foo","age":1}]}`,
+		},
+		{
+			Name:     "should not deflate duplicate with fewer fields",
+			Given:    `{"root":[{"__typename":"foo","id":1,"name":"foo","age":1},{"__typename":"foo","id":1,"name":"foo"}]}`,
+			Expected: `{"root":[{"__typename":"foo","id":1,"name":"foo","age":1},{"__typename":"foo","id":1,"name":"foo"}]}`,
+		},
+		{
+			Name:     "should not deflate duplicate with different nested selection",
+			Given:    `{"root":[{"__typename":"foo","id":1,"child":{"name":"foo"}},{"__typename":"foo","id":1,"child":{"name":"foo","age":1}}]}`,
+			Expected: `{"root":[{"__typename":"foo","id":1,"child":{"name":"foo"}},{"__typename":"foo","id":1,"child":{"name":"foo","age":1}}]}`,
+		},
+		{
+			Name:     "should keep comparing against first occurrence",
+			Given:    `{"root":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"title":"foo"},{"__typename":"foo","id":1,"title":"foo"},{"__typename":"foo","id":1,"name":"foo"}]}`,
+			Expected: `{"root":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"title":"foo"},{"__typename":"foo","id":1,"title":"foo"},{"__typename":"foo","id":1}]}`,
+			Deflated: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			result, err := Deflate([]byte(test.Given))
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expected, string(result.Data))
+			assert.Equal(t, test.Deflated, result.Deflated)
+
+			inflated, err := Inflate(result.Data)
+			assert.NoError(t, err)
+			assert.JSONEq(t, test.Given, string(inflated.Data))
+		})
+	}
+}
+
+func TestDeflateConflict(t *testing.T) {
+	given := `{"root":[{"__typename":"foo","id":1,"name":"foo","age":1},{"__typename":"foo","id":1,"name":"bar","age":1},{"__typename":"foo","id":1,"name":"foo","age":1}]}`
+	conflicts := []Conflict{
+		{
+			Entity: Entity{
+				Path:        Path{"root"},
+				Typename:    "foo",
+				Identifiers: []string{"id"},
+				ID:          []interface{}{json.Number("1")},
+			},
+			Fields: []string{"name"},
+		},
+	}
+
+	t.Run("should deflate without comparing values by default", func(t *testing.T) {
+		result, err := Deflate([]byte(given))
+		assert.NoError(t, err)
+		assert.Equal(t, `{"root":[{"__typename":"foo","id":1,"name":"foo","age":1},{"__typename":"foo","id":1},{"__typename":"foo","id":1}]}`, string(result.Data))
+		assert.Empty(t, result.Conflicts)
+	})
+
+	t.Run("should deflate and report conflict on keep first", func(t *testing.T) {
+		result, err := NewDeflater(WithConflictPolicy(ConflictKeepFirst)).Deflate([]byte(given))
+		assert.NoError(t, err)
+		assert.Equal(t, `{"root":[{"__typename":"foo","id":1,"name":"foo","age":1},{"__typename":"foo","id":1},{"__typename":"foo","id":1}]}`, string(result.Data))
+		assert.Equal(t, conflicts, result.Conflicts)
+	})
+
+	t.Run("should keep conflicting duplicate in full on keep both", func(t *testing.T) {
+		result, err := NewDeflater(WithConflictPolicy(ConflictKeepBoth)).Deflate([]byte(given))
+		assert.NoError(t, err)
+		assert.Equal(t, `{"root":[{"__typename":"foo","id":1,"name":"foo","age":1},{"__typename":"foo","id":1,"name":"bar","age":1},{"__typename":"foo","id":1}]}`, string(result.Data))
+		assert.Equal(t, conflicts, result.Conflicts)
+		assert.True(t, result.Deflated)
+	})
+
+	t.Run("should return error on fail", func(t *testing.T) {
+		result, err := NewDeflater(WithConflictPolicy(ConflictFail)).Deflate([]byte(given))
+		assert.Nil(t, result)
+
+		var conflictErr *ConflictError
+		assert.True(t, errors.As(err, &conflictErr))
+		assert.Equal(t, conflicts[0], conflictErr.Conflict)
+		assert.EqualError(t, err, "conflicting values of foo [1] at root in fields [name]")
+	})
+}
+
+func TestDeflateValue(t *testing.T) {
+	given := `{"root":[{"__typename":"foo","id":1,"child":{"__typename":"bar","id":2,"name":"bar"}},{"__typename":"foo","id":2,"child":{"__typename":"bar","id":2,"name":"bar"}},{"__typename":"foo","id":1,"child":{"__typename":"bar","id":2,"name":"bar"}}],"other":{"name":"baz"}}`
+	expected := `{"root":[{"__typename":"foo","id":1,"child":{"__typename":"bar","id":2,"name":"bar"}},{"__typename":"foo","id":2,"child":{"__typename":"bar","id":2}},{"__typename":"foo","id":1}],"other":{"name":"baz"}}`
+
+	decode := func(t *testing.T) interface{} {
+		var value interface{}
+		assert.NoError(t, json.Unmarshal([]byte(given), &value))
+		return value
+	}
+
+	t.Run("should deflate decoded value in place", func(t *testing.T) {
+		value := decode(t)
+		result, err := DeflateValue(value)
+		assert.NoError(t, err)
+		assert.True(t, result.Deflated)
+
+		data, err := json.Marshal(result.Value)
+		assert.NoError(t, err)
+		assert.JSONEq(t, expected, string(data))
+
+		data, err = json.Marshal(value)
+		assert.NoError(t, err)
+		assert.JSONEq(t, expected, string(data))
+	})
+
+	t.Run("should leave decoded value untouched on copy on write", func(t *testing.T) {
+		value := decode(t)
+		result, err := NewDeflater(WithCopyOnWrite()).DeflateValue(value)
+		assert.NoError(t, err)
+		assert.True(t, result.Deflated)
+
+		data, err := json.Marshal(result.Value)
+		assert.NoError(t, err)
+		assert.JSONEq(t, expected, string(data))
+
+		data, err = json.Marshal(value)
+		assert.NoError(t, err)
+		assert.JSONEq(t, given, string(data))
+
+		other := value.(map[string]interface{})["other"]
+		assert.Equal(t, other, result.Value.(map[string]interface{})["other"])
+	})
+
+	t.Run("should compare selection of nested decoded objects", func(t *testing.T) {
+		given := `[{"__typename":"T","id":1,"a":{"x":1}},{"__typename":"T","id":1,"a":{"y":2}}]`
+		var value interface{}
+		assert.NoError(t, json.Unmarshal([]byte(given), &value))
+
+		result, err := DeflateValue(value)
+		assert.NoError(t, err)
+		assert.False(t, result.Deflated)
+
+		inflated, err := InflateValue(result.Value)
+		assert.NoError(t, err)
+		data, err := json.Marshal(inflated.Value)
+		assert.NoError(t, err)
+		assert.JSONEq(t, given, string(data))
+	})
+
+	t.Run("should return scalar as is", func(t *testing.T) {
+		result, err := DeflateValue("foo")
+		assert.NoError(t, err)
+		assert.Equal(t, "foo", result.Value)
+		assert.False(t, result.Deflated)
+	})
+}
+
+func TestDeflateStats(t *testing.T) {
+	given := `{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"foo"}],"b":{"c":[{"__typename":"bar","id":1,"name":"bar"},{"__typename":"bar","id":1,"name":"bar"},{"__typename":"foo","id":1,"name":"foo"}]}}`
+	expected := Stats{
+		InputSize:  len(given),
+		OutputSize: 198,
+		Stubs:      2,
+		ByTypename: map[string]int{"foo": 1, "bar": 1},
+		ByPath:     map[string]int{"a": 1, "b.c": 1},
+	}
+
+	t.Run("should report stats", func(t *testing.T) {
+		result, err := Deflate([]byte(given))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, result.Stats)
+		assert.Equal(t, len(result.Data), result.Stats.OutputSize)
+	})
+
+	t.Run("should report stats with conflict policy", func(t *testing.T) {
+		result, err := NewDeflater(WithConflictPolicy(ConflictKeepFirst)).Deflate([]byte(given))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, result.Stats)
+	})
+
+	t.Run("should report stats of stream", func(t *testing.T) {
+		var buf bytes.Buffer
+		result, err := DeflateStream(strings.NewReader(given), &buf)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, result.Stats)
+		assert.Equal(t, buf.Len(), result.Stats.OutputSize)
+	})
+
+	t.Run("should report stats of value", func(t *testing.T) {
+		var value interface{}
+		assert.NoError(t, json.Unmarshal([]byte(given), &value))
+
+		result, err := DeflateValue(value)
+		assert.NoError(t, err)
+		assert.Equal(t, Stats{Stubs: 2, ByTypename: expected.ByTypename, ByPath: expected.ByPath}, result.Stats)
+	})
+
+	t.Run("should report sizes of whole response", func(t *testing.T) {
+		response := `{"data":` + given + `}`
+		result, err := DeflateResponse([]byte(response))
+		assert.NoError(t, err)
+		assert.Equal(t, len(response), result.Stats.InputSize)
+		assert.Equal(t, len(result.Data), result.Stats.OutputSize)
+		assert.Equal(t, 2, result.Stats.Stubs)
+	})
+
+	t.Run("should report empty stats without stub", func(t *testing.T) {
+		result, err := Deflate([]byte(`{"a":1}`))
+		assert.NoError(t, err)
+		assert.Equal(t, Stats{InputSize: 7, OutputSize: 7}, result.Stats)
+	})
+}
+
+func TestDeflateMinSaving(t *testing.T) {
+	// the stub save 13 bytes out of 89
+	given := `{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"foo"}]}`
+	deflated := `{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1}]}`
+
+	tests := []struct {
+		Name     string
+		Given    string
+		Options  []Option
+		Expected string
+		Deflated bool
+	}{
+		{
+			Name:     "should deflate when saving meet minimum",
+			Given:    given,
+			Options:  []Option{WithMinSaving(13), WithMinSavingRatio(0.14)},
+			Expected: deflated,
+			Deflated: true,
+		},
+		{
+			Name:     "should return input as is when saving is below minimum",
+			Given:    given,
+			Options:  []Option{WithMinSaving(14)},
+			Expected: given,
+		},
+		{
+			Name:     "should return input as is when saving is below minimum ratio",
+			Given:    given,
+			Options:  []Option{WithMinSavingRatio(0.15)},
+			Expected: given,
+		},
+		{
+			Name:     "should not count whitespace removed from compact output",
+			Given:    `{ "a": [ {"__typename": "foo", "id": 1, "name": "foo"}, {"__typename": "foo", "id": 1, "name": "foo"} ] }`,
+			Options:  []Option{WithMinSaving(14)},
+			Expected: `{ "a": [ {"__typename": "foo", "id": 1, "name": "foo"}, {"__typename": "foo", "id": 1, "name": "foo"} ] }`,
+		},
+		{
+			Name:     "should count whitespace of replaced object on verbatim output",
+			Given:    `{ "a": [ {"__typename": "foo", "id": 1, "name": "foo"}, {"__typename": "foo", "id": 1, "name": "foo"} ] }`,
+			Options:  []Option{WithMinSaving(18), WithVerbatimOutput()},
+			Expected: `{ "a": [ {"__typename": "foo", "id": 1, "name": "foo"}, {"__typename":"foo","id":1} ] }`,
+			Deflated: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			result, err := NewDeflater(test.Options...).Deflate([]byte(test.Given))
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expected, string(result.Data))
+			assert.Equal(t, test.Deflated, result.Deflated)
+			assert.Equal(t, len(result.Data), result.Stats.OutputSize)
+		})
+	}
+
+	t.Run("should not record extension when saving is below minimum", func(t *testing.T) {
+		result, err := NewDeflater(WithMinSaving(14)).DeflateResponse([]byte(`{"data":` + given + `}`))
+		assert.NoError(t, err)
+		assert.Equal(t, `{"data":`+given+`}`, string(result.Data))
+		assert.False(t, result.Deflated)
+	})
+}
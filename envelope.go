@@ -0,0 +1,237 @@
+package gqldeduplicator
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+const (
+	// Extension is the field under extensions of graphql response carrying deduplication metadata
+	Extension = "deduplicator"
+
+	extensionsField = "extensions"
+	dataField       = "data"
+	versionField    = "version"
+)
+
+var errNotResponse = errors.New("graphql response must be JSON object")
+
+type (
+	// envelope locate members of graphql response, indexes of data and extensions are -1 when absent
+	envelope struct {
+		scanner
+		members         []member
+		dataIndex       int
+		extensionsIndex int
+	}
+
+	// splice represent document range replaced by raw JSON value
+	splice struct {
+		start, end int
+		value      []byte
+	}
+)
+
+// DeflateResponse deflate data of complete graphql response by id as default identifier.
+// See Deflater.DeflateResponse.
+func DeflateResponse(response []byte) (*DeflateResult, error) {
+	return defaultDeflater.DeflateResponse(response)
+}
+
+// DeflateResponse deflate data of complete graphql response using deflater options, errors and other members are left as is.
+// When anything is deflated, {"deflated":true} is recorded under Extension in extensions of the response,
+// so client can tell deflated response apart without relying on HTTP header. Format other than FormatImplicit
+// is advertised by version, as in {"deflated":true,"version":2}.
+func (d *Deflater) DeflateResponse(response []byte) (*DeflateResult, error) {
+	env, err := newEnvelope(&d.config, response, d.config.maxDepth)
+	if err != nil {
+		return nil, err
+	}
+	if env.dataIndex < 0 {
+		output := env.splice(nil, d.config.verbatim)
+		return &DeflateResult{Data: output, Stats: Stats{InputSize: len(response), OutputSize: len(output)}}, nil
+	}
+
+	data := env.members[env.dataIndex]
+	result, err := d.deflate(response[data.value:data.valueEnd])
+	if err != nil {
+		return nil, err
+	}
+
+	splices := []splice{{start: data.value, end: data.valueEnd, value: result.Data}}
+	if result.Deflated {
+		extension := `{"deflated":true}`
+		if d.config.format != FormatImplicit {
+			extension = fmt.Sprintf(`{"deflated":true,"version":%d}`, d.config.format)
+		}
+		splices = append(splices, env.setExtension([]byte(extension)))
+	}
+
+	result.Data = env.splice(splices, d.config.verbatim)
+	result.Stats.InputSize, result.Stats.OutputSize = len(response), len(result.Data)
+	return result, nil
+}
+
+// InflateResponse inflate data of complete graphql response by id as identifier.
+// See Inflater.InflateResponse.
+func InflateResponse(response []byte) (*InflateResult, error) {
+	return defaultInflater.InflateResponse(response)
+}
+
+// InflateResponse inflate data of complete graphql response using inflater options, errors and other members are left as is.
+// Data is only inflated when Extension is recorded in extensions of the response, the record is removed afterward
+// along with extensions when nothing else is left in it. Data is inflated by format version advertised in the record,
+// regardless of WithFormat, record without version is FormatImplicit and record of unknown version is *FormatError.
+func (i *Inflater) InflateResponse(response []byte) (*InflateResult, error) {
+	result, _, err := i.inflateResponse(response)
+	return result, err
+}
+
+// inflateResponse inflate response as InflateResponse does, recorded report whether Extension is recorded in it
+func (i *Inflater) inflateResponse(response []byte) (result *InflateResult, recorded bool, err error) {
+	env, err := newEnvelope(&i.config, response, decoderDepth(i.config.maxDepth))
+	if err != nil {
+		return nil, false, err
+	}
+
+	removal, extension, ok := env.removeExtension()
+	if !ok || env.dataIndex < 0 {
+		return &InflateResult{Data: env.splice(nil, i.config.verbatim)}, ok, nil
+	}
+
+	format, err := env.format(extension)
+	if err != nil {
+		return nil, true, err
+	}
+	data := env.members[env.dataIndex]
+	result, err = i.withFormat(format).inflate(response[data.value:data.valueEnd])
+	if err != nil {
+		return nil, true, err
+	}
+
+	result.Data = env.splice([]splice{{start: data.value, end: data.valueEnd, value: result.Data}, removal}, i.config.verbatim)
+	if max := i.config.maxOutputSize; max > 0 && len(result.Data) > max {
+		return nil, true, &LimitError{Limit: LimitOutputSize, Max: max}
+	}
+	return result, true, nil
+}
+
+// newEnvelope validate response nested at most maxDepth deep and locate its members
+func newEnvelope(c *config, response []byte, maxDepth int) (*envelope, error) {
+	if err := c.validate(response, maxDepth); err != nil {
+		return nil, err
+	}
+	env := &envelope{scanner: scanner{data: response}}
+
+	start := env.skipSpace(0)
+	if env.data[start] != '{' {
+		return nil, errNotResponse
+	}
+
+	env.members, _ = env.scanMembers(start, nil)
+	env.dataIndex = env.findMember(env.members, dataField)
+	env.extensionsIndex = env.findMember(env.members, extensionsField)
+
+	return env, nil
+}
+
+// setExtension return splice setting Extension member of extensions to value, adding extensions when absent
+func (e *envelope) setExtension(value []byte) splice {
+	member := append([]byte(`"`+Extension+`":`), value...)
+	if e.extensionsIndex < 0 {
+		last := e.members[len(e.members)-1]
+		return splice{start: last.valueEnd, end: last.valueEnd, value: append(append([]byte(`,"extensions":{`), member...), '}')}
+	}
+
+	extensions := e.members[e.extensionsIndex]
+	if e.data[extensions.value] != '{' {
+		return splice{start: extensions.value, end: extensions.valueEnd, value: append(append([]byte{'{'}, member...), '}')}
+	}
+
+	members, _ := e.scanMembers(extensions.value, nil)
+	if k := e.findMember(members, Extension); k >= 0 {
+		return splice{start: members[k].value, end: members[k].valueEnd, value: value}
+	}
+	if len(members) == 0 {
+		return splice{start: extensions.value + 1, end: extensions.value + 1, value: member}
+	}
+	return splice{start: extensions.value + 1, end: extensions.value + 1, value: append(member, ',')}
+}
+
+// removeExtension return splice removing Extension member from extensions, along with extensions when nothing else is left,
+// and the removed Extension member, ok is false when Extension is absent
+func (e *envelope) removeExtension() (removal splice, extension member, ok bool) {
+	if e.extensionsIndex < 0 || e.data[e.members[e.extensionsIndex].value] != '{' {
+		return splice{}, member{}, false
+	}
+
+	members, _ := e.scanMembers(e.members[e.extensionsIndex].value, nil)
+	k := e.findMember(members, Extension)
+	if k < 0 {
+		return splice{}, member{}, false
+	}
+	if len(members) == 1 {
+		return removeMember(e.members, e.extensionsIndex), members[k], true
+	}
+
+	return removeMember(members, k), members[k], true
+}
+
+// format return format version recorded in Extension member, FormatImplicit when it is not recorded.
+// Version that is not understood is rejected, inflating by another version would leave stubs or break objects.
+func (e *envelope) format(extension member) (Format, error) {
+	if e.data[extension.value] != '{' {
+		return FormatImplicit, nil
+	}
+
+	members, _ := e.scanMembers(extension.value, nil)
+	k := e.findMember(members, versionField)
+	if k < 0 {
+		return FormatImplicit, nil
+	}
+	raw := string(e.data[members[k].value:members[k].valueEnd])
+	version, err := strconv.Atoi(raw)
+	if err != nil || version < int(FormatImplicit) || version > int(latestFormat) {
+		return 0, &FormatError{Version: raw}
+	}
+
+	return Format(version), nil
+}
+
+// splice copy document replacing every spliced range, compacted unless verbatim is set
+func (e *envelope) splice(splices []splice, verbatim bool) []byte {
+	sort.Slice(splices, func(i, j int) bool {
+		return splices[i].start < splices[j].start
+	})
+
+	out := make([]byte, 0, len(e.data))
+	start := 0
+	for _, s := range splices {
+		out = appendRange(out, e.data[start:s.start], verbatim)
+		out = append(out, s.value...)
+		start = s.end
+	}
+
+	return appendRange(out, e.data[start:], verbatim)
+}
+
+// removeMember return splice removing member k along with its separating comma
+func removeMember(members []member, k int) splice {
+	switch {
+	case k > 0:
+		return splice{start: members[k-1].valueEnd, end: members[k].valueEnd}
+	case len(members) > 1:
+		return splice{start: members[0].key, end: members[1].key}
+	}
+
+	return splice{start: members[0].key, end: members[0].valueEnd}
+}
+
+func appendRange(dst, src []byte, verbatim bool) []byte {
+	if verbatim {
+		return append(dst, src...)
+	}
+	return appendCompact(dst, src)
+}
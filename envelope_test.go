@@ -0,0 +1,143 @@
+package gqldeduplicator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeflateResponse(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Given    string
+		Expected string
+		Deflated bool
+	}{
+		{
+			Name:     "should record extension when data is deflated",
+			Given:    `{"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"foo"}]},"errors":[{"message":"oops","path":["a",1]}]}`,
+			Expected: `{"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1}]},"errors":[{"message":"oops","path":["a",1]}],"extensions":{"deduplicator":{"deflated":true}}}`,
+			Deflated: true,
+		},
+		{
+			Name:     "should add extension to existing extensions",
+			Given:    `{"extensions":{"cost":1},"data":{"a":[{"__typename":"foo","id":1},{"__typename":"foo","id":1}]}}`,
+			Expected: `{"extensions":{"deduplicator":{"deflated":true},"cost":1},"data":{"a":[{"__typename":"foo","id":1},{"__typename":"foo","id":1}]}}`,
+			Deflated: true,
+		},
+		{
+			Name:     "should replace null extensions",
+			Given:    `{"data":{"a":[{"__typename":"foo","id":1},{"__typename":"foo","id":1}]},"extensions":null}`,
+			Expected: `{"data":{"a":[{"__typename":"foo","id":1},{"__typename":"foo","id":1}]},"extensions":{"deduplicator":{"deflated":true}}}`,
+			Deflated: true,
+		},
+		{
+			Name:     "should leave response without duplicate as is",
+			Given:    `{ "data": {"a": [{"__typename":"foo","id":1}]}, "errors": [] }`,
+			Expected: `{"data":{"a":[{"__typename":"foo","id":1}]},"errors":[]}`,
+		},
+		{
+			Name:     "should leave response without data as is",
+			Given:    `{"errors":[{"message":"oops"}]}`,
+			Expected: `{"errors":[{"message":"oops"}]}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			result, err := DeflateResponse([]byte(test.Given))
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expected, string(result.Data))
+			assert.Equal(t, test.Deflated, result.Deflated)
+		})
+	}
+
+	t.Run("should keep response as is on verbatim output", func(t *testing.T) {
+		result, err := NewDeflater(WithVerbatimOutput()).DeflateResponse([]byte("{\n  \"data\": [{\"__typename\":\"foo\",\"id\":1},{\"__typename\":\"foo\", \"id\":1}],\n  \"extensions\": {}\n}"))
+		assert.NoError(t, err)
+		assert.Equal(t, "{\n  \"data\": [{\"__typename\":\"foo\",\"id\":1},{\"__typename\":\"foo\",\"id\":1}],\n  \"extensions\": {\"deduplicator\":{\"deflated\":true}}\n}", string(result.Data))
+	})
+
+	t.Run("should return error on response that is not object", func(t *testing.T) {
+		for _, given := range []string{`[]`, `null`, `{`} {
+			_, err := DeflateResponse([]byte(given))
+			assert.Error(t, err, given)
+		}
+	})
+}
+
+func TestInflateResponse(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Given    string
+		Expected string
+		Inflated bool
+	}{
+		{
+			Name:     "should inflate and remove extensions",
+			Given:    `{"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1}]},"errors":[{"message":"oops"}],"extensions":{"deduplicator":{"deflated":true}}}`,
+			Expected: `{"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"foo"}]},"errors":[{"message":"oops"}]}`,
+			Inflated: true,
+		},
+		{
+			Name:     "should keep other extensions",
+			Given:    `{"extensions":{"deduplicator":{"deflated":true},"cost":1},"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1}]}}`,
+			Expected: `{"extensions":{"cost":1},"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"foo"}]}}`,
+			Inflated: true,
+		},
+		{
+			Name:     "should keep preceding extensions",
+			Given:    `{"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1}]},"extensions":{"cost":1,"deduplicator":{"deflated":true}}}`,
+			Expected: `{"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"foo"}]},"extensions":{"cost":1}}`,
+			Inflated: true,
+		},
+		{
+			Name:     "should inflate by recorded format version",
+			Given:    `{"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"__deflated":true},{"__typename":"foo","id":1}]},"extensions":{"deduplicator":{"deflated":true,"version":2}}}`,
+			Expected: `{"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1}]}}`,
+			Inflated: true,
+		},
+		{
+			Name:     "should not inflate response without extension",
+			Given:    `{"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1}]}}`,
+			Expected: `{"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1}]}}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			result, err := InflateResponse([]byte(test.Given))
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expected, string(result.Data))
+			assert.Equal(t, test.Inflated, result.Inflated)
+		})
+	}
+
+	t.Run("should restore deflated response", func(t *testing.T) {
+		given := `{"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"foo"}]},"errors":[{"message":"oops"}]}`
+		deflated, err := DeflateResponse([]byte(given))
+		assert.NoError(t, err)
+
+		inflated, err := InflateResponse(deflated.Data)
+		assert.NoError(t, err)
+		assert.Equal(t, given, string(inflated.Data))
+	})
+
+	t.Run("should reject unknown format version", func(t *testing.T) {
+		for _, version := range []string{`0`, `3`, `"2"`} {
+			given := `{"data":{"a":[{"__typename":"foo","id":1}]},"extensions":{"deduplicator":{"deflated":true,"version":` + version + `}}}`
+			result, err := InflateResponse([]byte(given))
+			assert.Equal(t, &FormatError{Version: version}, err)
+			assert.Nil(t, result)
+		}
+	})
+
+	t.Run("should record format version", func(t *testing.T) {
+		given := `{"data":{"a":[{"__typename":"foo","id":1,"name":"foo bar baz"},{"__typename":"foo","id":1,"name":"foo bar baz"}]}}`
+		deflated, err := NewDeflater(WithFormat(FormatMarked)).DeflateResponse([]byte(given))
+		assert.NoError(t, err)
+		assert.Equal(t, `{"data":{"a":[{"__typename":"foo","id":1,"name":"foo bar baz"},{"__typename":"foo","id":1,"__deflated":true}]},"extensions":{"deduplicator":{"deflated":true,"version":2}}}`, string(deflated.Data))
+
+		inflated, err := InflateResponse(deflated.Data)
+		assert.NoError(t, err)
+		assert.Equal(t, given, string(inflated.Data))
+	})
+}
@@ -0,0 +1,122 @@
+package gqldeduplicator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const (
+	// LimitDepth limit nesting depth of objects and lists
+	LimitDepth Limit = iota
+	// LimitInputSize limit input size in bytes
+	LimitInputSize
+	// LimitEntities limit number of entities memoized on deflate or collected on inflate
+	LimitEntities
+	// LimitOutputSize limit inflated output size in bytes
+	LimitOutputSize
+
+	// snippetSize is the number of input bytes kept on each side of syntax error offset
+	snippetSize = 16
+)
+
+type (
+	// Limit represent limit set by options against hostile or pathological input
+	Limit int
+
+	// LimitError represent input exceeding limit, Max is the limit set by options
+	LimitError struct {
+		Limit Limit
+		Max   int
+	}
+
+	// SyntaxError represent invalid JSON input, Offset is the input byte offset where it is detected
+	// and Snippet is input around Offset, Snippet is empty when input is read from stream
+	SyntaxError struct {
+		Msg     string
+		Offset  int
+		Snippet string
+	}
+
+	// ConflictError represent deflate aborted by conflict under ConflictFail policy
+	ConflictError struct {
+		Conflict Conflict
+	}
+
+	// UnresolvedError represent stub whose full object is not found on inflate
+	UnresolvedError struct {
+		Entity Entity
+	}
+
+	// FormatError represent response deflated in format Version that is not understood, as advertised by it
+	FormatError struct {
+		Version string
+	}
+)
+
+// String return limit description
+func (l Limit) String() string {
+	switch l {
+	case LimitDepth:
+		return "depth"
+	case LimitInputSize:
+		return "input size"
+	case LimitEntities:
+		return "entities"
+	case LimitOutputSize:
+		return "output size"
+	}
+
+	return fmt.Sprintf("Limit(%d)", int(l))
+}
+
+// Error return limit description
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s exceeds limit of %d", e.Limit, e.Max)
+}
+
+// Error return syntax error description
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at offset %d", e.Msg, e.Offset)
+}
+
+// Error return conflict description
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflicting values of %s %v at %s in fields %v",
+		e.Conflict.Typename, e.Conflict.ID, e.Conflict.Path, e.Conflict.Fields)
+}
+
+// Error return unresolved stub description
+func (e *UnresolvedError) Error() string {
+	return fmt.Sprintf("unresolved reference to %s %v at %s", e.Entity.Typename, e.Entity.ID, e.Entity.Path)
+}
+
+// Error return unknown format description
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("unknown format version %s", e.Version)
+}
+
+// newSyntaxError create syntax error at offset of data, with snippet of data around it
+func newSyntaxError(msg string, data []byte, offset int) *SyntaxError {
+	start, end := offset-snippetSize, offset+snippetSize
+	if start < 0 {
+		start = 0
+	}
+	if end > len(data) {
+		end = len(data)
+	}
+
+	return &SyntaxError{Msg: msg, Offset: offset, Snippet: string(data[start:end])}
+}
+
+// decoderError convert syntax error of json.Decoder into *SyntaxError, other errors are returned as is
+func decoderError(err error, dec *json.Decoder) error {
+	if e, ok := err.(*json.SyntaxError); ok {
+		return &SyntaxError{Msg: e.Error(), Offset: int(e.Offset)}
+	}
+	if err == io.ErrUnexpectedEOF {
+		return &SyntaxError{Msg: "unexpected end of JSON input", Offset: int(dec.InputOffset())}
+	}
+
+	return err
+}
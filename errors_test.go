@@ -0,0 +1,84 @@
+package gqldeduplicator
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyntaxError(t *testing.T) {
+	run := map[string]func(data string) error{
+		"Deflate": func(data string) error {
+			_, err := Deflate([]byte(data))
+			return err
+		},
+		"Inflate": func(data string) error {
+			_, err := Inflate([]byte(data))
+			return err
+		},
+		"DeflateResponse": func(data string) error {
+			_, err := DeflateResponse([]byte(`{"data":` + data + `}`))
+			return err
+		},
+		"InflateInto": func(data string) error {
+			var v interface{}
+			return InflateInto([]byte(data), &v)
+		},
+		"DeflateStream": func(data string) error {
+			_, err := DeflateStream(strings.NewReader(data), &bytes.Buffer{})
+			return err
+		},
+		"InflateStream": func(data string) error {
+			_, err := InflateStream(strings.NewReader(data), &bytes.Buffer{})
+			return err
+		},
+	}
+
+	tests := []struct {
+		Name  string
+		Given string
+	}{
+		{
+			Name:  "invalid character",
+			Given: `{"root":[{"__typename":"foo","id":1,}]}`,
+		},
+		{
+			Name:  "unexpected end",
+			Given: `{"root":[{"__typename":"foo","id":1}`,
+		},
+		{
+			Name:  "trailing data",
+			Given: `{"root":[]} {}`,
+		},
+	}
+	for _, test := range tests {
+		for name, f := range run {
+			t.Run(name+" should report "+test.Name, func(t *testing.T) {
+				var syntax *SyntaxError
+				err := f(test.Given)
+				if assert.True(t, errors.As(err, &syntax), "%v", err) {
+					assert.NotZero(t, syntax.Offset)
+					assert.Contains(t, err.Error(), "at offset")
+				}
+			})
+		}
+	}
+
+	t.Run("should locate invalid character with snippet", func(t *testing.T) {
+		given := `{"root":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,}]}`
+		_, err := Deflate([]byte(given))
+		assert.Equal(t, &SyntaxError{
+			Msg:     `invalid character '}' looking for beginning of object key string`,
+			Offset:  77,
+			Snippet: `e":"foo","id":1,}]}`,
+		}, err)
+	})
+}
+
+func TestUnresolvedError(t *testing.T) {
+	err := error(&UnresolvedError{Entity: Entity{Path: Path{"root"}, Typename: "foo", ID: []interface{}{1}}})
+	assert.EqualError(t, err, "unresolved reference to foo [1] at root")
+}
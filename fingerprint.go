@@ -0,0 +1,201 @@
+package gqldeduplicator
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+
+	scalarShape = 1
+	objectShape = 2
+	arrayShape  = 3
+)
+
+type (
+	// fingerprint represent fields of an object, each field name hash map to hashes of its value.
+	fingerprint map[uint64]valueHash
+
+	// valueHash represent hashes of a value. Shape cover nested field names and list lengths but not scalar values,
+	// so two objects with equal shapes carry the same selection, while value also cover scalar values.
+	valueHash struct {
+		shape uint64
+		value uint64
+	}
+
+	// objectHasher combine member hashes of an object into its valueHash
+	objectHasher struct {
+		hash valueHash
+	}
+
+	// arrayHasher combine item hashes of a list into its valueHash
+	arrayHasher struct {
+		hash   valueHash
+		length uint64
+	}
+
+	// hashCache hold hash of every object hashed during a walk, so that nested objects are hashed once
+	// however deep they are. An object must not change once hashed, which hold for walks that take
+	// fingerprint of an object before replacing its members. Nil cache hash without caching.
+	hashCache map[*object]valueHash
+)
+
+// newFingerprint create fingerprint of object fields, hashes of nested objects are cached in hashes
+func newFingerprint(value *object, hashes hashCache) fingerprint {
+	f := make(fingerprint, len(value.keys))
+	for _, k := range value.keys {
+		f[nameHash(k)] = hashes.hash(value.values[k])
+	}
+
+	return f
+}
+
+// sameSelection check whether both fingerprints have the same fields with the same shapes
+func (f fingerprint) sameSelection(other fingerprint) bool {
+	if len(f) != len(other) {
+		return false
+	}
+	for k, hash := range f {
+		if otherHash, ok := other[k]; !ok || otherHash.shape != hash.shape {
+			return false
+		}
+	}
+
+	return true
+}
+
+// diff return fields of keys whose value differ between both fingerprints, in the order of keys
+func (f fingerprint) diff(other fingerprint, keys []string) []string {
+	var fields []string
+	for _, k := range keys {
+		if f[nameHash(k)].value != other[nameHash(k)].value {
+			fields = append(fields, k)
+		}
+	}
+
+	return fields
+}
+
+// hashOf hash value shape and value, object members are combined regardless of their order
+func hashOf(node interface{}) valueHash {
+	return hashCache(nil).hash(node)
+}
+
+// hash hash value like hashOf, reusing and caching hash of objects
+func (c hashCache) hash(node interface{}) valueHash {
+	switch value := node.(type) {
+	case *object:
+		if hash, ok := c[value]; ok {
+			return hash
+		}
+		hasher := newObjectHasher()
+		for _, k := range value.keys {
+			hasher.add(nameHash(k), c.hash(value.values[k]))
+		}
+		hash := hasher.sum()
+		if c != nil {
+			c[value] = hash
+		}
+		return hash
+	case map[string]interface{}:
+		// members are combined regardless of their order, so map hash the same as object of its members
+		hasher := newObjectHasher()
+		for k, v := range value {
+			hasher.add(nameHash(k), c.hash(v))
+		}
+		return hasher.sum()
+	case []interface{}:
+		hasher := newArrayHasher()
+		for _, v := range value {
+			hasher.add(c.hash(v))
+		}
+		return hasher.sum()
+	}
+
+	return valueHash{shape: scalarShape, value: hashScalar(node)}
+}
+
+func newObjectHasher() objectHasher {
+	return objectHasher{hash: valueHash{shape: objectShape, value: objectShape}}
+}
+
+// add combine member hash, the result does not depend on the order members are added
+func (h *objectHasher) add(name uint64, member valueHash) {
+	h.hash.shape += mix(name ^ member.shape)
+	h.hash.value += mix(name ^ member.value)
+}
+
+func (h *objectHasher) sum() valueHash {
+	return valueHash{shape: mix(h.hash.shape), value: mix(h.hash.value)}
+}
+
+func newArrayHasher() arrayHasher {
+	return arrayHasher{hash: valueHash{shape: arrayShape, value: arrayShape}}
+}
+
+// add combine item hash in order
+func (h *arrayHasher) add(item valueHash) {
+	h.hash.shape = mix(h.hash.shape*prime64 ^ item.shape)
+	h.hash.value = mix(h.hash.value*prime64 ^ item.value)
+	h.length++
+}
+
+func (h *arrayHasher) sum() valueHash {
+	return valueHash{shape: mix(h.hash.shape ^ h.length), value: mix(h.hash.value ^ h.length)}
+}
+
+// hashScalar hash scalar value, prefixed by its kind so that string "1" and number 1 differ
+func hashScalar(node interface{}) uint64 {
+	switch value := node.(type) {
+	case nil:
+		return hashString(offset64, "null")
+	case bool:
+		if value {
+			return hashString(offset64, "true")
+		}
+		return hashString(offset64, "false")
+	case string:
+		return hashString(hashString(offset64, "s"), value)
+	case json.Number:
+		return hashString(hashString(offset64, "n"), string(value))
+	}
+
+	return hashString(hashString(offset64, "n"), fmt.Sprint(node))
+}
+
+// nameHash hash field name
+func nameHash(name string) uint64 {
+	return hashString(offset64, name)
+}
+
+// hashString hash s using FNV-1a starting from hash
+func hashString(hash uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		hash ^= uint64(s[i])
+		hash *= prime64
+	}
+
+	return hash
+}
+
+// mix scramble bits of hash so that combined hashes do not cancel each other
+func mix(hash uint64) uint64 {
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
+
+// hashBytes hash b using FNV-1a starting from hash
+func hashBytes(hash uint64, b []byte) uint64 {
+	for _, c := range b {
+		hash ^= uint64(c)
+		hash *= prime64
+	}
+
+	return hash
+}
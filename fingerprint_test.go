@@ -0,0 +1,86 @@
+package gqldeduplicator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprintSameSelection(t *testing.T) {
+	fingerprintOf := func(data string) fingerprint {
+		node, err := decode([]byte(data))
+		assert.NoError(t, err)
+		return newFingerprint(node.(*object), nil)
+	}
+
+	tests := []struct {
+		Name  string
+		A     string
+		B     string
+		Equal bool
+	}{
+		{
+			Name:  "should be equal regardless of scalar values and field order",
+			A:     `{"id":1,"name":"foo","tags":["a"],"child":{"x":1,"y":null}}`,
+			B:     `{"name":"bar","id":2,"tags":["b"],"child":{"y":true,"x":"z"}}`,
+			Equal: true,
+		},
+		{
+			Name: "should differ on missing field",
+			A:    `{"id":1,"name":"foo"}`,
+			B:    `{"id":1}`,
+		},
+		{
+			Name: "should differ on different field with the same count",
+			A:    `{"id":1,"name":"foo"}`,
+			B:    `{"id":1,"title":"foo"}`,
+		},
+		{
+			Name: "should differ on nested field",
+			A:    `{"id":1,"child":{"x":1}}`,
+			B:    `{"id":1,"child":{"x":1,"y":1}}`,
+		},
+		{
+			Name: "should differ on null and object",
+			A:    `{"id":1,"child":null}`,
+			B:    `{"id":1,"child":{}}`,
+		},
+		{
+			Name: "should differ on list length",
+			A:    `{"id":1,"items":[{"x":1}]}`,
+			B:    `{"id":1,"items":[{"x":1},{"x":2}]}`,
+		},
+		{
+			Name: "should differ on fields moved between list items",
+			A:    `{"id":1,"items":[{"x":1},{"x":1,"y":1}]}`,
+			B:    `{"id":1,"items":[{"x":1,"y":1},{"x":1}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			assert.Equal(t, test.Equal, fingerprintOf(test.A).sameSelection(fingerprintOf(test.B)))
+			assert.Equal(t, test.Equal, fingerprintOf(test.B).sameSelection(fingerprintOf(test.A)))
+		})
+	}
+}
+
+func TestFingerprintDiff(t *testing.T) {
+	fingerprintOf := func(data string) (fingerprint, []string) {
+		node, err := decode([]byte(data))
+		assert.NoError(t, err)
+		return newFingerprint(node.(*object), nil), node.(*object).keys
+	}
+
+	t.Run("should return fields with different values", func(t *testing.T) {
+		a, _ := fingerprintOf(`{"id":1,"name":"foo","age":1,"tags":["a"],"child":{"x":1},"flag":true}`)
+		b, keys := fingerprintOf(`{"id":1,"name":"bar","age":"1","tags":["a"],"child":{"x":2},"flag":true}`)
+		assert.Equal(t, []string{"name", "age", "child"}, a.diff(b, keys))
+	})
+
+	t.Run("should return nothing for equal values", func(t *testing.T) {
+		a, _ := fingerprintOf(`{"id":1,"child":{"x":1,"y":[null,false]}}`)
+		b, keys := fingerprintOf(`{"child":{"y":[null,false],"x":1},"id":1}`)
+		assert.Empty(t, a.diff(b, keys))
+	})
+}
@@ -0,0 +1,201 @@
+package gqldeduplicator
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// Header is set to format version on deflated graphql response, client may also set it on request
+	// to opt in deduplication with the highest format version it understand
+	Header = "GraphQL-Deduplicator"
+	// QueryParam opt in deduplication with format version it is set to in request URL
+	QueryParam = "deduplicate"
+
+	// transportMaxOutputSize limit inflated body of Transport whose inflater does not set WithMaxOutputSize
+	transportMaxOutputSize = 64 << 20
+)
+
+type (
+	// Transport add deduplication opt in to every request and inflate deflated response before caller read it,
+	// it is safe for concurrent use
+	Transport struct {
+		// Base is the underlying round tripper, http.DefaultTransport is used when it is nil
+		Base http.RoundTripper
+		// Inflater inflate deflated response, inflater with default options is used when it is nil.
+		// Inflated body is limited to 64 MiB unless it set WithMaxOutputSize.
+		Inflater *Inflater
+	}
+
+	// bufferedResponse hold response written by handler until it is deflated
+	bufferedResponse struct {
+		header http.Header
+		status int
+		body   bytes.Buffer
+	}
+)
+
+// Middleware deflate graphql response of next handler by id as default identifier.
+// See Deflater.Middleware.
+func Middleware(next http.Handler) http.Handler {
+	return defaultDeflater.Middleware(next)
+}
+
+// Middleware deflate graphql response of next handler using deflater options, when request opt in deduplication
+// by QueryParam or Header set to format version. Response is buffered and only data is deflated as DeflateResponse does,
+// in the lower of requested format and WithFormat, then Header is set to that format and Content-Length is fixed.
+// Request opting in by unknown later version is served in WithFormat, version below FormatImplicit does not opt in.
+// Response that is not successful JSON response, is already encoded or cannot be deflated is written as is.
+func (d *Deflater) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", Header)
+		format := requestedFormat(r)
+		if format == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// client understanding a later version, even one unknown here, understand every earlier one
+		if format > d.config.format {
+			format = d.config.format
+		}
+
+		buffered := &bufferedResponse{header: w.Header(), status: http.StatusOK}
+		next.ServeHTTP(buffered, r)
+
+		body := buffered.body.Bytes()
+		if buffered.deflatable() {
+			if result, err := d.withFormat(format).DeflateResponse(body); err == nil && result.Deflated {
+				body = result.Data
+				w.Header().Set(Header, strconv.Itoa(int(format)))
+			}
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(buffered.status)
+		_, _ = w.Write(body)
+	})
+}
+
+// requestedFormat return format version request opt in deduplication with, zero when it does not opt in
+func requestedFormat(r *http.Request) Format {
+	value := r.URL.Query().Get(QueryParam)
+	if value == "" {
+		value = r.Header.Get(Header)
+	}
+
+	return parseFormat(value)
+}
+
+// parseFormat parse format version of Header or QueryParam, zero when it is not a valid version
+func parseFormat(value string) Format {
+	version, err := strconv.Atoi(value)
+	if err != nil || version < int(FormatImplicit) {
+		return 0
+	}
+
+	return Format(version)
+}
+
+// Header return header of the underlying response writer, so handler set it directly
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+// WriteHeader remember status code to be written once response is deflated
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+// Write buffer body
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	return b.body.Write(data)
+}
+
+// deflatable check whether response is successful JSON response without content encoding,
+// response without content type is given a try since it is not sniffed yet
+func (b *bufferedResponse) deflatable() bool {
+	if b.status != http.StatusOK || b.header.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	contentType := b.header.Get("Content-Type")
+	if contentType == "" {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/json" || mediaType == "application/graphql-response+json"
+}
+
+// RoundTrip send request with Header set to format of Inflater, then inflate response body when response carry Header.
+// Header is removed from inflated response and Content-Length is fixed, so caller read it as a plain graphql response.
+// Response carrying Header of unknown later version is *FormatError.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	inflater := t.Inflater
+	if inflater == nil {
+		inflater = defaultInflater
+	}
+	if inflater.config.maxOutputSize == 0 {
+		limited := *inflater
+		limited.config.maxOutputSize = transportMaxOutputSize
+		inflater = &limited
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set(Header, strconv.Itoa(int(inflater.config.format)))
+	resp, err := base.RoundTrip(req)
+	if err != nil || resp.Header.Get("Content-Encoding") != "" {
+		return resp, err
+	}
+	format := parseFormat(resp.Header.Get(Header))
+	if format == 0 {
+		return resp, nil
+	}
+	if format > latestFormat {
+		_ = resp.Body.Close()
+		return nil, &FormatError{Version: resp.Header.Get(Header)}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err = inflate(inflater.withFormat(format), body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Header.Del(Header)
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.ContentLength = int64(len(body))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// inflate inflate response recorded by DeflateResponse, or whole body deflated by server that does not record it
+func inflate(inflater *Inflater, body []byte) ([]byte, error) {
+	result, recorded, err := inflater.inflateResponse(body)
+	if err != nil {
+		return nil, err
+	}
+	if !recorded {
+		if result, err = inflater.Inflate(body); err != nil {
+			return nil, err
+		}
+	}
+
+	return result.Data, nil
+}
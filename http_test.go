@@ -0,0 +1,280 @@
+package gqldeduplicator
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	response := `{"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"foo"}]}}`
+	deflated := `{"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1}]},"extensions":{"deduplicator":{"deflated":true}}}`
+
+	handler := func(status int, contentType, body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Length", "999")
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(body))
+		})
+	}
+
+	tests := []struct {
+		Name        string
+		URL         string
+		Header      string
+		Status      int
+		ContentType string
+		Body        string
+		Expected    string
+		Deflated    bool
+	}{
+		{
+			Name:        "should deflate response opted in by query parameter",
+			URL:         "/query?deduplicate=1",
+			Status:      http.StatusOK,
+			ContentType: "application/json; charset=utf-8",
+			Body:        response,
+			Expected:    deflated,
+			Deflated:    true,
+		},
+		{
+			Name:        "should deflate response opted in by header",
+			URL:         "/query",
+			Header:      "1",
+			Status:      http.StatusOK,
+			ContentType: "application/graphql-response+json",
+			Body:        response,
+			Expected:    deflated,
+			Deflated:    true,
+		},
+		{
+			Name:        "should deflate response in format of deflater when opted in by unknown later version",
+			URL:         "/query",
+			Header:      "3",
+			Status:      http.StatusOK,
+			ContentType: "application/json",
+			Body:        response,
+			Expected:    deflated,
+			Deflated:    true,
+		},
+		{
+			Name:        "should not deflate response opted in by version below implicit format",
+			URL:         "/query?deduplicate=0",
+			Status:      http.StatusOK,
+			ContentType: "application/json",
+			Body:        response,
+			Expected:    response,
+		},
+		{
+			Name:        "should not deflate response without opt in",
+			URL:         "/query",
+			Status:      http.StatusOK,
+			ContentType: "application/json",
+			Body:        response,
+			Expected:    response,
+		},
+		{
+			Name:        "should not deflate unsuccessful response",
+			URL:         "/query?deduplicate=1",
+			Status:      http.StatusBadRequest,
+			ContentType: "application/json",
+			Body:        response,
+			Expected:    response,
+		},
+		{
+			Name:        "should not deflate response that is not json",
+			URL:         "/query?deduplicate=1",
+			Status:      http.StatusOK,
+			ContentType: "text/html",
+			Body:        response,
+			Expected:    response,
+		},
+		{
+			Name:        "should write invalid response as is",
+			URL:         "/query?deduplicate=1",
+			Status:      http.StatusOK,
+			ContentType: "application/json",
+			Body:        `{"data":`,
+			Expected:    `{"data":`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, test.URL, nil)
+			if test.Header != "" {
+				request.Header.Set(Header, test.Header)
+			}
+			recorder := httptest.NewRecorder()
+
+			Middleware(handler(test.Status, test.ContentType, test.Body)).ServeHTTP(recorder, request)
+
+			assert.Equal(t, test.Status, recorder.Code)
+			assert.Equal(t, test.Expected, recorder.Body.String())
+			assert.Equal(t, []string{Header}, recorder.Header()["Vary"])
+			if test.Deflated {
+				assert.Equal(t, "1", recorder.Header().Get(Header))
+			} else {
+				assert.Empty(t, recorder.Header().Get(Header))
+			}
+			if requestedFormat(request) != 0 {
+				assert.Equal(t, strconv.Itoa(len(test.Expected)), recorder.Header().Get("Content-Length"))
+			}
+		})
+	}
+}
+
+func TestTransport(t *testing.T) {
+	response := `{"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"foo"}]}}`
+
+	t.Run("should opt in and inflate response deflated by middleware", func(t *testing.T) {
+		server := httptest.NewServer(Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(response))
+		})))
+		defer server.Close()
+
+		client := &http.Client{Transport: &Transport{}}
+		resp, err := client.Post(server.URL, "application/json", nil)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, response, string(body))
+		assert.Equal(t, int64(len(response)), resp.ContentLength)
+		assert.Empty(t, resp.Header.Get(Header))
+	})
+
+	t.Run("should inflate whole body deflated without extension", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "1", r.Header.Get(Header))
+			w.Header().Set(Header, "1")
+			_, _ = w.Write([]byte(`{"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1}]}}`))
+		}))
+		defer server.Close()
+
+		client := &http.Client{Transport: &Transport{Base: http.DefaultTransport, Inflater: NewInflater()}}
+		resp, err := client.Get(server.URL)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, response, string(body))
+	})
+
+	t.Run("should reject response deflated in unknown later version", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(Header, "3")
+			_, _ = w.Write([]byte(`{"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1}]}}`))
+		}))
+		defer server.Close()
+
+		client := &http.Client{Transport: &Transport{}}
+		_, err := client.Get(server.URL)
+		var formatErr *FormatError
+		assert.True(t, errors.As(err, &formatErr))
+		assert.Equal(t, &FormatError{Version: "3"}, formatErr)
+	})
+
+	t.Run("should remove extension of response without stubs", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(Header, "1")
+			_, _ = w.Write([]byte(`{"data":{"a":[{"__typename":"foo","id":1}]},"extensions":{"deduplicator":{"version":1}}}`))
+		}))
+		defer server.Close()
+
+		client := &http.Client{Transport: &Transport{}}
+		resp, err := client.Get(server.URL)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"data":{"a":[{"__typename":"foo","id":1}]}}`, string(body))
+	})
+
+	t.Run("should negotiate format", func(t *testing.T) {
+		response := `{"data":{"a":[{"__typename":"foo","id":1,"name":"foo","description":"foo"},{"__typename":"foo","id":1,"name":"foo","description":"foo"}]}}`
+		tests := []struct {
+			Name     string
+			Server   *Deflater
+			Client   *Inflater
+			Expected string
+		}{
+			{
+				Name:     "marked format when both support it",
+				Server:   NewDeflater(WithFormat(FormatMarked)),
+				Client:   NewInflater(WithFormat(FormatMarked)),
+				Expected: "2",
+			},
+			{
+				Name:     "implicit format for old client",
+				Server:   NewDeflater(WithFormat(FormatMarked)),
+				Client:   NewInflater(),
+				Expected: "1",
+			},
+			{
+				Name:     "implicit format for old server",
+				Server:   NewDeflater(),
+				Client:   NewInflater(WithFormat(FormatMarked)),
+				Expected: "1",
+			},
+		}
+		for _, test := range tests {
+			t.Run(test.Name, func(t *testing.T) {
+				server := httptest.NewServer(test.Server.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					_, _ = w.Write([]byte(response))
+				})))
+				defer server.Close()
+
+				recorder := &headerRecorder{}
+				client := &http.Client{Transport: &Transport{Base: recorder, Inflater: test.Client}}
+				resp, err := client.Get(server.URL)
+				assert.NoError(t, err)
+				defer resp.Body.Close()
+
+				body, err := ioutil.ReadAll(resp.Body)
+				assert.NoError(t, err)
+				assert.Equal(t, response, string(body))
+				assert.Equal(t, test.Expected, recorder.header)
+			})
+		}
+	})
+
+	t.Run("should leave response without header as is", func(t *testing.T) {
+		given := `{"data":{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1}]}}`
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(given))
+		}))
+		defer server.Close()
+
+		client := &http.Client{Transport: &Transport{}}
+		resp, err := client.Get(server.URL)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, given, string(body))
+	})
+}
+
+// headerRecorder record Header of response before Transport inflate it
+type headerRecorder struct {
+	header string
+}
+
+func (h *headerRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err == nil {
+		h.header = resp.Header.Get(Header)
+	}
+	return resp, err
+}
@@ -1,98 +1,429 @@
 package gqldeduplicator
 
 import (
+	"bytes"
 	"encoding/json"
-	"fmt"
+	"reflect"
+	"sort"
+	"sync"
 )
 
-const inflatedKey = "__inflated_key__"
+const (
+	// UnresolvedIgnore leave stub without full object as is
+	UnresolvedIgnore UnresolvedPolicy = iota
+	// UnresolvedReport leave stub without full object as is and report it
+	UnresolvedReport
+	// UnresolvedFail abort inflate with *UnresolvedError
+	UnresolvedFail
+
+	// maxPooledBuffer is the largest buffer kept in bufferPool, larger ones are left to the garbage collector
+	maxPooledBuffer = 1 << 20
+)
 
 type (
-	// InflateResult represent inflated object result
+	// InflateResult represent inflated object result, Unresolved is only reported under UnresolvedReport policy
 	InflateResult struct {
-		Data     []byte
-		Inflated bool
+		Data       []byte
+		Inflated   bool
+		Unresolved []Entity
+	}
+
+	// InflateValueResult represent inflated value result, Unresolved is only reported under UnresolvedReport policy
+	InflateValueResult struct {
+		Value      interface{}
+		Inflated   bool
+		Unresolved []Entity
 	}
+
+	// UnresolvedPolicy decide what to do with object that looks like a stub but whose full object is not found
+	UnresolvedPolicy int
+
+	// Inflater inflate deflated graphql response with its options, it is safe for concurrent use
+	Inflater struct {
+		config config
+	}
+
+	inflateState struct {
+		config   *config
+		entities map[string]*object
+		edits    []edit
+		inflated bool
+		// paths hold path of every full object from root, global keys are those of global typename
+		root       *pathNode
+		paths      map[string]*pathNode
+		globalKeys map[string]bool
+		// replaced count stubs replaced by full object, a subtree is changed when it grows while walking it
+		replaced int
+		// resolved hold full objects already inflated by resolve, visiting hold those being inflated
+		resolved   map[string]*object
+		visiting   map[string]bool
+		unresolved []Entity
+	}
+)
+
+var (
+	defaultInflater = NewInflater()
+
+	// bufferPool hold buffers InflateInto encode inflated document into
+	bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
 )
 
+// NewInflater create inflater, identifier is id and typename field is __typename unless set by options
+func NewInflater(opts ...Option) *Inflater {
+	return &Inflater{config: newConfig(opts)}
+}
+
 // Inflate inflate similar object in graphql response by id as identifier.
-// Use deep first search (DFS) algorithm to walk over nodes and memoize object.
-// If object appeared or memoized before, then it will inflated.
+// First pass walk over nodes using deep first search (DFS) algorithm and collect every full object,
+// second pass replace every deflated object with the collected one, regardless of which appears first.
 func Inflate(data []byte) (*InflateResult, error) {
-	var node interface{}
-	err := json.Unmarshal(data, &node)
+	return defaultInflater.Inflate(data)
+}
+
+// InflateWithCustomIdentifier inflate similar object in graphql response by identifier.
+// First pass walk over nodes using deep first search (DFS) algorithm and collect every full object,
+// second pass replace every deflated object with the collected one, regardless of which appears first.
+//
+// Deprecated: use NewInflater(WithIdentifier(identifier)).Inflate(data) instead.
+func InflateWithCustomIdentifier(data []byte, identifier string) (*InflateResult, error) {
+	return NewInflater(WithIdentifier(identifier)).Inflate(data)
+}
+
+// Inflate inflate similar object in graphql response using inflater options.
+// First pass walk over nodes using deep first search (DFS) algorithm and collect every full object,
+// second pass replace every deflated object with the collected one, regardless of which appears first.
+func (i *Inflater) Inflate(data []byte) (*InflateResult, error) {
+	if err := i.config.validate(data, decoderDepth(i.config.maxDepth)); err != nil {
+		return nil, err
+	}
+
+	return i.inflate(data)
+}
+
+func newInflateState(c *config) *inflateState {
+	return &inflateState{
+		config:     c,
+		entities:   make(map[string]*object),
+		root:       newPath(),
+		paths:      make(map[string]*pathNode),
+		globalKeys: make(map[string]bool),
+	}
+}
+
+// withFormat return inflater using format, the inflater itself when it already does
+func (i *Inflater) withFormat(format Format) *Inflater {
+	if format == i.config.format {
+		return i
+	}
+
+	inflater := *i
+	inflater.config.format = format
+	return &inflater
+}
+
+// inflate inflate validated data
+func (i *Inflater) inflate(data []byte) (*InflateResult, error) {
+	node, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	state := newInflateState(&i.config)
+	node, err = state.run(node)
 	if err != nil {
 		return nil, err
 	}
 
-	memoize := make(map[string]interface{})
-	resultByte, err := json.Marshal(inflate(node, memoize, "id", ""))
+	state.sortEdits()
+	resultByte, err := encode(data, node, state.edits, state.config.verbatim, state.config.maxOutputSize)
 	if err != nil {
 		return nil, err
 	}
 
 	return &InflateResult{
-		Data:     resultByte,
-		Inflated: memoize[inflatedKey] != nil,
+		Data:       resultByte,
+		Inflated:   state.inflated,
+		Unresolved: state.unresolved,
 	}, nil
 }
 
-// InflateWithCustomIdentifier inflate similar object in graphql response by identifier.
-// Use deep first search (DFS) algorithm to walk over nodes and memoize object.
-// If object appeared or memoized before, then it will inflated.
-func InflateWithCustomIdentifier(data []byte, identifier string) (*InflateResult, error) {
-	var node interface{}
-	err := json.Unmarshal(data, &node)
-	if err != nil {
+// InflateValue inflate similar object in graphql response already decoded by encoding/json into interface{}.
+// See Inflater.InflateValue.
+func InflateValue(v interface{}) (*InflateValueResult, error) {
+	return defaultInflater.InflateValue(v)
+}
+
+// InflateValue inflate similar object in value made of map[string]interface{}, []interface{} and scalars,
+// as decoded by encoding/json. Every stub is replaced by the very same map of the full object, not by a copy.
+// Maps and lists of v are modified in place, unless WithCopyOnWrite is set,
+// then v is left untouched and only maps and lists on the way to an inflated stub are copied.
+func (i *Inflater) InflateValue(v interface{}) (*InflateValueResult, error) {
+	if err := checkDepth(v, i.config.maxDepth); err != nil {
 		return nil, err
 	}
 
-	memoize := make(map[string]interface{})
-	resultByte, err := json.Marshal(inflate(node, memoize, identifier, ""))
+	config := i.config
+	config.verbatim = false
+	state := newInflateState(&config)
+	value, err := state.run(v)
 	if err != nil {
 		return nil, err
 	}
 
-	return &InflateResult{
-		Data:     resultByte,
-		Inflated: memoize[inflatedKey] != nil,
+	return &InflateValueResult{
+		Value:      value,
+		Inflated:   state.inflated,
+		Unresolved: state.unresolved,
 	}, nil
 }
 
-func inflate(node interface{}, memoize map[string]interface{}, identifier, path string) interface{} {
+// InflateInto inflate similar object in graphql response by id as identifier and store the result in dst.
+// See Inflater.InflateInto.
+func InflateInto(data []byte, dst interface{}) error {
+	return defaultInflater.InflateInto(data, dst)
+}
+
+// InflateInto inflate similar object in graphql response using inflater options and store the result
+// in the value pointed to by dst. The inflated document is rendered verbatim into a pooled buffer and decoded
+// by json.Unmarshal, so dst and errors are those of json.Unmarshal, offsets refer to the inflated document.
+// Unresolved stubs are not reported under UnresolvedReport policy, since there is no result.
+func (i *Inflater) InflateInto(data []byte, dst interface{}) error {
+	target := reflect.ValueOf(dst)
+	if target.Kind() != reflect.Ptr || target.IsNil() {
+		return &json.InvalidUnmarshalError{Type: reflect.TypeOf(dst)}
+	}
+
+	if err := i.config.validate(data, decoderDepth(i.config.maxDepth)); err != nil {
+		return err
+	}
+	node, err := decode(data)
+	if err != nil {
+		return err
+	}
+
+	config := i.config
+	config.verbatim = true
+	state := newInflateState(&config)
+	node, err = state.run(node)
+	if err != nil {
+		return err
+	}
+
+	state.sortEdits()
+	buf := bufferPool.Get().(*bytes.Buffer)
+	defer putBuffer(buf)
+	if err := encodeTo(buf, data, node, state.edits, true, config.maxOutputSize); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buf.Bytes(), dst)
+}
+
+// sortEdits sort edits by position, full object of global typename may be inflated before its position,
+// out of document order
+func (s *inflateState) sortEdits() {
+	sort.Slice(s.edits, func(a, b int) bool {
+		return s.edits[a].start < s.edits[b].start
+	})
+}
+
+// run collect every full object then replace every stub with it
+func (s *inflateState) run(node interface{}) (interface{}, error) {
+	if err := s.collect(node, s.root); err != nil {
+		return nil, err
+	}
+
+	return s.inflate(node, s.root)
+}
+
+// collect memoize the first full object of every key
+func (s *inflateState) collect(node interface{}, path *pathNode) error {
 	switch value := node.(type) {
 	case []interface{}:
-		for i, v := range value {
-			switch v.(type) {
-			case []interface{}, map[string]interface{}:
-				value[i] = inflate(v, memoize, identifier, path)
-			default:
-				value[i] = v
+		for _, v := range value {
+			if err := s.collect(v, path); err != nil {
+				return err
 			}
 		}
-		return value
 	case map[string]interface{}:
-		if value != nil && value[identifier] != nil && value["__typename"] != nil {
-			key := fmt.Sprintf("%s,%v,%v", path, value["__typename"], value[identifier])
-			if memoize[key] != nil {
-				memoize[inflatedKey] = true
-				return memoize[key]
+		return s.collect(mapObject(value), path)
+	case *object:
+		if entity, ok := s.config.entity(value, path); ok && !s.config.isStub(value, entity) {
+			key, err := s.config.key(entity, path)
+			if err != nil {
+				return err
+			}
+			if s.entities[key] == nil {
+				if err := s.config.checkEntities(len(s.entities) + 1); err != nil {
+					return err
+				}
+				s.entities[key] = value
+				s.paths[key] = path
+				if s.config.isGlobal(entity.Typename) {
+					s.globalKeys[key] = true
+				}
 			}
+		}
 
-			memoize[key] = value
+		for _, k := range value.keys {
+			if err := s.collect(value.values[k], path.child(k)); err != nil {
+				return err
+			}
 		}
+	}
 
-		for k, v := range value {
-			switch v.(type) {
-			case []interface{}, map[string]interface{}:
-				value[k] = inflate(v, memoize, identifier, path+","+k)
-			default:
-				value[k] = v
+	return nil
+}
+
+func (s *inflateState) inflate(node interface{}, path *pathNode) (interface{}, error) {
+	switch value := node.(type) {
+	case []interface{}:
+		return s.inflateList(value, path)
+	case *object:
+		return s.inflateObject(value, path)
+	case map[string]interface{}:
+		inflated, err := s.inflateObject(mapObject(value), path)
+		if err != nil {
+			return nil, err
+		}
+		return inflated.values, nil
+	}
+
+	return node, nil
+}
+
+func (s *inflateState) inflateList(value []interface{}, path *pathNode) ([]interface{}, error) {
+	copied := false
+	for i, v := range value {
+		if !isContainer(v) {
+			continue
+		}
+
+		replaced := s.replaced
+		child, err := s.inflate(v, path)
+		if err != nil {
+			return nil, err
+		}
+		if s.replaced == replaced {
+			continue
+		}
+		if s.config.copyOnWrite && !copied {
+			value, copied = append([]interface{}(nil), value...), true
+		}
+		value[i] = child
+	}
+
+	return value, nil
+}
+
+func (s *inflateState) inflateObject(value *object, path *pathNode) (*object, error) {
+	if entity, ok := s.config.entity(value, path); ok {
+		isStub := s.config.isStub(value, entity)
+		if isStub || s.config.copyOnWrite || s.config.isGlobal(entity.Typename) {
+			key, err := s.config.key(entity, path)
+			if err != nil {
+				return nil, err
+			}
+
+			full := s.entities[key]
+			switch {
+			case isStub && (full == nil || s.visiting[key]):
+				// stub inside its own full object is unresolved too, inflating it would make a cycle
+				if s.unresolved, err = unresolve(s.config, s.unresolved, entity, path); err != nil {
+					return nil, err
+				}
+			case isStub:
+				s.inflated = true
+				s.config.notify(entity, path)
+				if s.config.verbatim {
+					s.edits = append(s.edits, edit{start: value.start, end: value.end, value: full})
+				}
+				s.replaced++
+				return s.resolve(key, full)
+			case full != nil && full.same(value):
+				resolved, err := s.resolve(key, full)
+				if err != nil {
+					return nil, err
+				}
+				if !resolved.same(value) {
+					s.replaced++
+				}
+				return resolved, nil
 			}
 		}
+	}
+
+	return s.inflateMembers(value, path)
+}
+
+// unresolve handle stub at path whose full object is not found by policy, reported entity is appended to unresolved
+func unresolve(c *config, unresolved []Entity, entity Entity, path *pathNode) ([]Entity, error) {
+	switch c.unresolvedPolicy {
+	case UnresolvedReport:
+		return append(unresolved, entity.at(path)), nil
+	case UnresolvedFail:
+		return nil, &UnresolvedError{Entity: entity.at(path)}
+	}
+
+	return unresolved, nil
+}
+
+// resolve return full object of key with its own stubs inflated. Under copy-on-write the full object is inflated once
+// into a copy shared by every occurrence, otherwise it is inflated in place, where it appears in the document
+// unless it is global, then it is inflated once on its first occurrence or stub, whichever comes first.
+func (s *inflateState) resolve(key string, full *object) (*object, error) {
+	if !s.config.copyOnWrite && !s.globalKeys[key] {
+		return full, nil
+	}
+	if resolved, ok := s.resolved[key]; ok {
+		return resolved, nil
+	}
+
+	if s.resolved == nil {
+		s.resolved = make(map[string]*object)
+		s.visiting = make(map[string]bool)
+	}
+	s.visiting[key] = true
+	resolved, err := s.inflateMembers(full, s.paths[key])
+	if err != nil {
+		return nil, err
+	}
+	delete(s.visiting, key)
+	s.resolved[key] = resolved
+
+	return resolved, nil
+}
+
+func (s *inflateState) inflateMembers(value *object, path *pathNode) (*object, error) {
+	copied := false
+	for _, k := range value.keys {
+		v := value.values[k]
+		if !isContainer(v) {
+			continue
+		}
 
-		return value
+		replaced := s.replaced
+		child, err := s.inflate(v, path.child(k))
+		if err != nil {
+			return nil, err
+		}
+		if s.replaced == replaced {
+			continue
+		}
+		if s.config.copyOnWrite && !copied {
+			value, copied = value.clone(), true
+		}
+		value.values[k] = child
 	}
 
-	return node
+	return value, nil
+}
+
+// putBuffer return buffer to bufferPool unless it is too large to keep
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
 }
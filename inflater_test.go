@@ -1,6 +1,10 @@
 package gqldeduplicator
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -734,3 +738,390 @@ func TestInflateIdentifier(t *testing.T) {
 		assert.Nil(t, result)
 	})
 }
+
+func TestInflateStubBeforeFullObject(t *testing.T) {
+	given := []byte(`
+	{
+		"root": [
+			{
+				"__typename": "foo",
+				"id": 1
+			},
+			{
+				"__typename": "foo",
+				"id": 1,
+				"name": "foo",
+				"child": {
+					"__typename": "bar",
+					"id": 1
+				}
+			},
+			{
+				"__typename": "foo",
+				"id": 2,
+				"name": "foo 2",
+				"child": {
+					"__typename": "bar",
+					"id": 1,
+					"name": "bar"
+				}
+			}
+		]
+	}`)
+	expected := []byte(`
+	{
+		"root": [
+			{
+				"__typename": "foo",
+				"id": 1,
+				"name": "foo",
+				"child": {
+					"__typename": "bar",
+					"id": 1,
+					"name": "bar"
+				}
+			},
+			{
+				"__typename": "foo",
+				"id": 1,
+				"name": "foo",
+				"child": {
+					"__typename": "bar",
+					"id": 1,
+					"name": "bar"
+				}
+			},
+			{
+				"__typename": "foo",
+				"id": 2,
+				"name": "foo 2",
+				"child": {
+					"__typename": "bar",
+					"id": 1,
+					"name": "bar"
+				}
+			}
+		]
+	}`)
+
+	t.Run("should inflate stub that appears before its full object", func(t *testing.T) {
+		result, err := Inflate(given)
+		assert.NoError(t, err)
+		assert.JSONEq(t, string(expected), string(result.Data))
+		assert.True(t, result.Inflated)
+	})
+}
+
+func TestInflater(t *testing.T) {
+	given := []byte(`
+	{
+		"root": [
+			{"kind": "foo", "uuid": 1, "name": "foo"},
+			{"kind": "foo", "uuid": 1},
+			{"kind": "bar", "uuid": 1, "name": "bar"},
+			{"kind": "bar", "uuid": 1}
+		]
+	}`)
+
+	t.Run("should inflate with custom typename field and identifier", func(t *testing.T) {
+		var hooked []Entity
+		inflater := NewInflater(
+			WithIdentifier("uuid"),
+			WithTypenameField("kind"),
+			WithHook(func(entity Entity) {
+				hooked = append(hooked, entity)
+			}),
+		)
+
+		result, err := inflater.Inflate(given)
+		assert.NoError(t, err)
+		assert.True(t, result.Inflated)
+		assert.JSONEq(t, `
+		{
+			"root": [
+				{"kind": "foo", "uuid": 1, "name": "foo"},
+				{"kind": "foo", "uuid": 1, "name": "foo"},
+				{"kind": "bar", "uuid": 1, "name": "bar"},
+				{"kind": "bar", "uuid": 1, "name": "bar"}
+			]
+		}`, string(result.Data))
+		assert.Equal(t, []Entity{
+			{Path: Path{"root"}, Typename: "foo", Identifiers: []string{"uuid"}, ID: []interface{}{json.Number("1")}},
+			{Path: Path{"root"}, Typename: "bar", Identifiers: []string{"uuid"}, ID: []interface{}{json.Number("1")}},
+		}, hooked)
+	})
+
+	t.Run("should only inflate entity allowed by rules", func(t *testing.T) {
+		inflater := NewInflater(
+			WithIdentifier("uuid"),
+			WithTypenameField("kind"),
+			WithRule(func(entity Entity) bool {
+				return entity.Typename != "foo"
+			}),
+		)
+
+		result, err := inflater.Inflate(given)
+		assert.NoError(t, err)
+		assert.True(t, result.Inflated)
+		assert.JSONEq(t, `
+		{
+			"root": [
+				{"kind": "foo", "uuid": 1, "name": "foo"},
+				{"kind": "foo", "uuid": 1},
+				{"kind": "bar", "uuid": 1, "name": "bar"},
+				{"kind": "bar", "uuid": 1, "name": "bar"}
+			]
+		}`, string(result.Data))
+	})
+
+	t.Run("should inflate by per type identifier and composite key", func(t *testing.T) {
+		inflater := NewInflater(
+			WithIdentifier("id", "uuid"),
+			WithTypeIdentifier("Repo", "orgId", "slug"),
+		)
+
+		result, err := inflater.Inflate([]byte(`
+		{
+			"root": [
+				{"__typename": "User", "id": 1, "name": "foo"},
+				{"__typename": "User", "id": 1},
+				{"__typename": "Token", "uuid": "a", "name": "foo"},
+				{"__typename": "Token", "uuid": "a"},
+				{"__typename": "Repo", "id": 1, "orgId": 1, "slug": "foo", "name": "foo"},
+				{"__typename": "Repo", "orgId": 2, "slug": "foo"},
+				{"__typename": "Repo", "orgId": 1, "slug": "foo"}
+			]
+		}`))
+		assert.NoError(t, err)
+		assert.True(t, result.Inflated)
+		assert.JSONEq(t, `
+		{
+			"root": [
+				{"__typename": "User", "id": 1, "name": "foo"},
+				{"__typename": "User", "id": 1, "name": "foo"},
+				{"__typename": "Token", "uuid": "a", "name": "foo"},
+				{"__typename": "Token", "uuid": "a", "name": "foo"},
+				{"__typename": "Repo", "id": 1, "orgId": 1, "slug": "foo", "name": "foo"},
+				{"__typename": "Repo", "orgId": 2, "slug": "foo"},
+				{"__typename": "Repo", "id": 1, "orgId": 1, "slug": "foo", "name": "foo"}
+			]
+		}`, string(result.Data))
+	})
+}
+
+func TestInflateNumbers(t *testing.T) {
+	t.Run("should inflate large identifiers without losing precision", func(t *testing.T) {
+		result, err := Inflate([]byte(`{"root":[{"__typename":"foo","id":9007199254740993,"name":"foo","price":1.50},{"__typename":"foo","id":9007199254740992,"name":"bar"},{"__typename":"foo","id":9007199254740993}]}`))
+		assert.NoError(t, err)
+		assert.Equal(t, `{"root":[{"__typename":"foo","id":9007199254740993,"name":"foo","price":1.50},{"__typename":"foo","id":9007199254740992,"name":"bar"},{"__typename":"foo","id":9007199254740993,"name":"foo","price":1.50}]}`, string(result.Data))
+		assert.True(t, result.Inflated)
+	})
+}
+
+func TestInflateVerbatimOutput(t *testing.T) {
+	given := `{
+	"zeta": "<b>café</b>",
+	"root": [
+		{"__typename": "foo", "id": 1, "child": {"__typename": "bar", "id": 2}},
+		{"__typename": "foo", "id": 1},
+		{"__typename": "foo", "id": 2, "child": {"__typename": "bar", "id": 2, "url": "a\/b"}}
+	]
+}`
+	expected := `{
+	"zeta": "<b>café</b>",
+	"root": [
+		{"__typename": "foo", "id": 1, "child": {"__typename": "bar", "id": 2, "url": "a\/b"}},
+		{"__typename": "foo", "id": 1, "child": {"__typename": "bar", "id": 2, "url": "a\/b"}},
+		{"__typename": "foo", "id": 2, "child": {"__typename": "bar", "id": 2, "url": "a\/b"}}
+	]
+}`
+
+	t.Run("should only change inflated object", func(t *testing.T) {
+		result, err := NewInflater(WithVerbatimOutput()).Inflate([]byte(given))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(result.Data))
+		assert.True(t, result.Inflated)
+	})
+}
+
+func TestInflateValue(t *testing.T) {
+	given := `{"root":[{"__typename":"foo","id":1},{"__typename":"foo","id":2,"child":{"__typename":"bar","id":2}},{"__typename":"foo","id":1,"child":{"__typename":"bar","id":2,"name":"bar"}}]}`
+	expected := `{"root":[{"__typename":"foo","id":1,"child":{"__typename":"bar","id":2,"name":"bar"}},{"__typename":"foo","id":2,"child":{"__typename":"bar","id":2,"name":"bar"}},{"__typename":"foo","id":1,"child":{"__typename":"bar","id":2,"name":"bar"}}]}`
+
+	decode := func(t *testing.T) interface{} {
+		var value interface{}
+		assert.NoError(t, json.Unmarshal([]byte(given), &value))
+		return value
+	}
+
+	t.Run("should inflate decoded value in place", func(t *testing.T) {
+		value := decode(t)
+		result, err := InflateValue(value)
+		assert.NoError(t, err)
+		assert.True(t, result.Inflated)
+
+		data, err := json.Marshal(result.Value)
+		assert.NoError(t, err)
+		assert.JSONEq(t, expected, string(data))
+
+		data, err = json.Marshal(value)
+		assert.NoError(t, err)
+		assert.JSONEq(t, expected, string(data))
+	})
+
+	t.Run("should leave decoded value untouched on copy on write", func(t *testing.T) {
+		value := decode(t)
+		result, err := NewInflater(WithCopyOnWrite()).InflateValue(value)
+		assert.NoError(t, err)
+		assert.True(t, result.Inflated)
+
+		data, err := json.Marshal(result.Value)
+		assert.NoError(t, err)
+		assert.JSONEq(t, expected, string(data))
+
+		data, err = json.Marshal(value)
+		assert.NoError(t, err)
+		assert.JSONEq(t, given, string(data))
+	})
+
+	t.Run("should inflate decoded value of global identity like Inflate", func(t *testing.T) {
+		given := `[{"__typename":"A","id":1,"n":1,"c":{"__typename":"B","id":1,"n":1,"a":{"__typename":"A","id":1}}},{"__typename":"B","id":1}]`
+		inflater := NewInflater(WithGlobalIdentity())
+		var value interface{}
+		assert.NoError(t, json.Unmarshal([]byte(given), &value))
+
+		result, err := inflater.InflateValue(value)
+		assert.NoError(t, err)
+		data, err := json.Marshal(result.Value)
+		assert.NoError(t, err)
+
+		inflated, err := inflater.Inflate([]byte(given))
+		assert.NoError(t, err)
+		assert.JSONEq(t, string(inflated.Data), string(data))
+	})
+}
+
+func TestInflateInto(t *testing.T) {
+	type (
+		author struct {
+			ID   int    `json:"id"`
+			Name string `json:"name"`
+		}
+		story struct {
+			ID     int     `json:"id"`
+			Author *author `json:"author"`
+		}
+		response struct {
+			Stories []story `json:"stories"`
+		}
+	)
+
+	t.Run("should inflate into struct", func(t *testing.T) {
+		var result response
+		err := InflateInto([]byte(`{"stories":[{"__typename":"Story","id":1,"author":{"__typename":"User","id":1}},{"__typename":"Story","id":2,"author":{"__typename":"User","id":1,"name":"foo"}}]}`), &result)
+		assert.NoError(t, err)
+		assert.Equal(t, response{Stories: []story{
+			{ID: 1, Author: &author{ID: 1, Name: "foo"}},
+			{ID: 2, Author: &author{ID: 1, Name: "foo"}},
+		}}, result)
+	})
+
+	t.Run("should return error on invalid destination", func(t *testing.T) {
+		var result response
+		assert.Error(t, InflateInto([]byte(`{}`), result))
+		assert.Error(t, InflateInto([]byte(`{}`), nil))
+	})
+
+	t.Run("should return error on invalid json", func(t *testing.T) {
+		var result response
+		assert.Error(t, InflateInto([]byte(`{`), &result))
+	})
+
+	t.Run("should decode the same as json.Unmarshal of inflated document", func(t *testing.T) {
+		type options struct {
+			Count  int             `json:"count,string"`
+			Raw    json.RawMessage `json:"raw"`
+			Ratio  float64         `json:"ratio"`
+			Any    interface{}     `json:"any"`
+			Author *author         `json:"author"`
+		}
+		for _, given := range []string{
+			`{"count":"12","raw":{ "b" : 1, "a" : [ 2 ] },"author":{"__typename":"User","id":1,"name":"foo"}}`,
+			`{"a":{"__typename":"User","id":1,"name":"foo"},"raw":[{"__typename":"User","id":1}],"author":{"__typename":"User","id":1}}`,
+			`{"ratio":1e400,"any":1e400}`,
+			`{"count":"x","raw":{"a":1},"author":{"id":"1"}}`,
+			`{"count":12}`,
+			`[1]`,
+		} {
+			inflated, err := NewInflater(WithVerbatimOutput()).Inflate([]byte(given))
+			assert.NoError(t, err, given)
+			var expected options
+			expectedErr := json.Unmarshal(inflated.Data, &expected)
+
+			var actual options
+			err = InflateInto([]byte(given), &actual)
+			assert.Equal(t, expected, actual, given)
+			assert.Equal(t, expectedErr, err, given)
+		}
+	})
+}
+
+func TestInflateUnresolved(t *testing.T) {
+	given := `{"root":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1},{"__typename":"foo","id":2}],"other":{"__typename":"bar","id":3}}`
+	unresolved := []Entity{
+		{Path: Path{"root"}, Typename: "foo", Identifiers: []string{"id"}, ID: []interface{}{json.Number("2")}},
+		{Path: Path{"other"}, Typename: "bar", Identifiers: []string{"id"}, ID: []interface{}{json.Number("3")}},
+	}
+
+	run := map[string]func(opts []Option) ([]Entity, error){
+		"Inflate": func(opts []Option) ([]Entity, error) {
+			result, err := NewInflater(opts...).Inflate([]byte(given))
+			if err != nil {
+				return nil, err
+			}
+			return result.Unresolved, nil
+		},
+		"InflateStream": func(opts []Option) ([]Entity, error) {
+			result, err := NewInflater(opts...).InflateStream(strings.NewReader(given), &bytes.Buffer{})
+			if err != nil {
+				return nil, err
+			}
+			return result.Unresolved, nil
+		},
+		"InflateValue": func(opts []Option) ([]Entity, error) {
+			var value interface{}
+			decoder := json.NewDecoder(strings.NewReader(given))
+			decoder.UseNumber()
+			if err := decoder.Decode(&value); err != nil {
+				return nil, err
+			}
+
+			result, err := NewInflater(opts...).InflateValue(value)
+			if err != nil {
+				return nil, err
+			}
+			return result.Unresolved, nil
+		},
+	}
+	for name, f := range run {
+		t.Run(name+" should ignore unresolved stubs by default", func(t *testing.T) {
+			result, err := f(nil)
+			assert.NoError(t, err)
+			assert.Nil(t, result)
+		})
+
+		t.Run(name+" should report unresolved stubs", func(t *testing.T) {
+			result, err := f([]Option{WithUnresolvedPolicy(UnresolvedReport)})
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, unresolved, result)
+		})
+
+		t.Run(name+" should fail on unresolved stub", func(t *testing.T) {
+			_, err := f([]Option{WithUnresolvedPolicy(UnresolvedFail)})
+			var unresolvedErr *UnresolvedError
+			if assert.True(t, errors.As(err, &unresolvedErr), "%v", err) {
+				assert.Contains(t, unresolved, unresolvedErr.Entity)
+			}
+		})
+	}
+}
@@ -0,0 +1,407 @@
+package gqldeduplicator
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"sort"
+)
+
+type (
+	// object represent JSON object that remembers the order of its members as they appear in the source document
+	object struct {
+		keys   []string
+		values map[string]interface{}
+		// start and end locate the object in the source document, end is zero for object built in memory
+		start, end int
+	}
+
+	// writer is implemented by bytes.Buffer and bufio.Writer
+	writer interface {
+		io.Writer
+		io.ByteWriter
+		io.StringWriter
+	}
+
+	// limitWriter write to the underlying writer and fail with *LimitError once more than max bytes are written,
+	// unless max is zero. Output is only measured when the underlying writer is nil.
+	limitWriter struct {
+		w      writer
+		n, max int
+	}
+
+	// edit represent source range replaced by value, value is rendered from source when it is decoded object
+	edit struct {
+		start, end int
+		value      interface{}
+	}
+)
+
+func newObject() *object {
+	return &object{values: make(map[string]interface{})}
+}
+
+// mapObject view decoded map as object with keys in sorted order, the map is shared and not copied
+func mapObject(value map[string]interface{}) *object {
+	keys := make([]string, 0, len(value))
+	for k := range value {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return &object{keys: keys, values: value}
+}
+
+// same check whether both objects are the same object, views of the same decoded map are the same object
+func (o *object) same(other *object) bool {
+	return o == other || reflect.ValueOf(o.values).Pointer() == reflect.ValueOf(other.values).Pointer()
+}
+
+// clone return shallow copy of object, member values are shared
+func (o *object) clone() *object {
+	values := make(map[string]interface{}, len(o.values))
+	for k, v := range o.values {
+		values[k] = v
+	}
+
+	return &object{keys: o.keys, values: values, start: o.start, end: o.end}
+}
+
+// set set member value, appending the key if it is not present yet
+func (o *object) set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+// isContainer check whether node is object or list
+func isContainer(node interface{}) bool {
+	switch node.(type) {
+	case *object, map[string]interface{}, []interface{}:
+		return true
+	}
+	return false
+}
+
+// checkNesting check that container nested depth deep is within maxDepth, unless maxDepth is zero
+func checkNesting(depth, maxDepth int) error {
+	if maxDepth > 0 && depth > maxDepth {
+		return &LimitError{Limit: LimitDepth, Max: maxDepth}
+	}
+	return nil
+}
+
+// decoderDepth return maxDepth bounded by nesting limit of json.Decoder, so document that is decoded
+// fails with *LimitError before json.Decoder fails on its own
+func decoderDepth(maxDepth int) int {
+	if maxDepth <= 0 || maxDepth > defaultMaxDepth {
+		return defaultMaxDepth
+	}
+	return maxDepth
+}
+
+// checkDepth check that objects and lists of node are nested at most maxDepth deep, unless maxDepth is zero.
+// Node is walked by explicit stack, so deep node can not overflow goroutine stack.
+func checkDepth(node interface{}, maxDepth int) error {
+	if maxDepth <= 0 {
+		return nil
+	}
+
+	type item struct {
+		node  interface{}
+		depth int
+	}
+	stack := []item{{node: node}}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !isContainer(top.node) {
+			continue
+		}
+		if top.depth == maxDepth {
+			return &LimitError{Limit: LimitDepth, Max: maxDepth}
+		}
+
+		switch value := top.node.(type) {
+		case map[string]interface{}:
+			for _, v := range value {
+				stack = append(stack, item{node: v, depth: top.depth + 1})
+			}
+		case []interface{}:
+			for _, v := range value {
+				stack = append(stack, item{node: v, depth: top.depth + 1})
+			}
+		case *object:
+			for _, v := range value.values {
+				stack = append(stack, item{node: v, depth: top.depth + 1})
+			}
+		}
+	}
+
+	return nil
+}
+
+// MarshalJSON encode object with its members in document order
+func (o *object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	err := writeValue(&buf, o, true)
+	return buf.Bytes(), err
+}
+
+// decode parse JSON document into tree of *object, []interface{} and scalar values.
+// Unlike json.Unmarshal into interface{}, object members keep their document order
+// and numbers are kept as json.Number, so they are encoded back exactly as written.
+func decode(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	node, err := decodeValue(dec, data, 0, 0)
+	if err != nil {
+		return nil, decoderError(err, dec)
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		if err != nil {
+			return nil, decoderError(err, dec)
+		}
+		return nil, newSyntaxError("invalid data after top-level value", data, int(dec.InputOffset()))
+	}
+
+	return node, nil
+}
+
+// decodeValue decode next value, depth is the number of containers it is nested in
+// and it fails when it is nested deeper than maxDepth, unless maxDepth is zero
+func decodeValue(dec *json.Decoder, data []byte, depth, maxDepth int) (interface{}, error) {
+	start := skipSeparators(data, int(dec.InputOffset()))
+	token, err := nextToken(dec)
+	if err != nil {
+		return nil, err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		return decodeObject(dec, data, start, depth+1, maxDepth)
+	case json.Delim('['):
+		return decodeList(dec, data, depth+1, maxDepth)
+	}
+
+	return token, nil
+}
+
+// decodeList decode items of list whose opening bracket is already read,
+// depth is the number of containers it is nested in including itself
+func decodeList(dec *json.Decoder, data []byte, depth, maxDepth int) ([]interface{}, error) {
+	if err := checkNesting(depth, maxDepth); err != nil {
+		return nil, err
+	}
+
+	value := make([]interface{}, 0)
+	for dec.More() {
+		item, err := decodeValue(dec, data, depth, maxDepth)
+		if err != nil {
+			return nil, err
+		}
+		value = append(value, item)
+	}
+	_, err := nextToken(dec)
+	return value, err
+}
+
+// decodeObject decode members of object whose opening brace at start is already read,
+// depth is the number of containers it is nested in including itself
+func decodeObject(dec *json.Decoder, data []byte, start, depth, maxDepth int) (*object, error) {
+	if err := checkNesting(depth, maxDepth); err != nil {
+		return nil, err
+	}
+
+	value := newObject()
+	for dec.More() {
+		token, err := nextToken(dec)
+		if err != nil {
+			return nil, err
+		}
+
+		member, err := decodeValue(dec, data, depth, maxDepth)
+		if err != nil {
+			return nil, err
+		}
+		value.set(token.(string), member)
+	}
+	if _, err := nextToken(dec); err != nil {
+		return nil, err
+	}
+
+	value.start, value.end = start, int(dec.InputOffset())
+	return value, nil
+}
+
+// nextToken read next token, treating end of input as unexpected since it is only called inside a value
+func nextToken(dec *json.Decoder) (json.Token, error) {
+	token, err := dec.Token()
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return token, err
+}
+
+// skipSeparators return offset of the first byte from offset that is not whitespace, comma or colon
+func skipSeparators(data []byte, offset int) int {
+	for offset < len(data) {
+		switch data[offset] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			offset++
+		default:
+			return offset
+		}
+	}
+
+	return offset
+}
+
+// encode encode node as compact JSON, or when verbatim is set copy data as is and only render edited ranges.
+// It fail with *LimitError once output exceed maxSize, unless maxSize is zero.
+func encode(data []byte, node interface{}, edits []edit, verbatim bool, maxSize int) ([]byte, error) {
+	var buf bytes.Buffer
+	err := encodeTo(&buf, data, node, edits, verbatim, maxSize)
+	return buf.Bytes(), err
+}
+
+// encodeTo encode node into buf as encode does
+func encodeTo(buf *bytes.Buffer, data []byte, node interface{}, edits []edit, verbatim bool, maxSize int) error {
+	w := &limitWriter{w: buf, max: maxSize}
+	if verbatim {
+		return render(w, data, 0, len(data), edits)
+	}
+
+	return writeValue(w, node, true)
+}
+
+// render copy data between start and end to buf, replacing every edited range in between.
+// Edits must be sorted and must not overlap.
+func render(buf writer, data []byte, start, end int, edits []edit) error {
+	i := sort.Search(len(edits), func(i int) bool {
+		return edits[i].start >= start
+	})
+	for ; i < len(edits) && edits[i].end <= end; i++ {
+		if _, err := buf.Write(data[start:edits[i].start]); err != nil {
+			return err
+		}
+		start = edits[i].end
+
+		if value, ok := edits[i].value.(*object); ok && value.end > 0 {
+			if err := render(buf, data, value.start, value.end, edits); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := writeValue(buf, edits[i].value, false); err != nil {
+			return err
+		}
+	}
+	_, err := buf.Write(data[start:end])
+
+	return err
+}
+
+// writeValue write compact JSON encoding of node to buf
+func writeValue(buf writer, node interface{}, escapeHTML bool) error {
+	switch value := node.(type) {
+	case *object:
+		if err := buf.WriteByte('{'); err != nil {
+			return err
+		}
+		for i, k := range value.keys {
+			if i > 0 {
+				if err := buf.WriteByte(','); err != nil {
+					return err
+				}
+			}
+			if err := writeValue(buf, k, escapeHTML); err != nil {
+				return err
+			}
+			if err := buf.WriteByte(':'); err != nil {
+				return err
+			}
+			if err := writeValue(buf, value.values[k], escapeHTML); err != nil {
+				return err
+			}
+		}
+		return buf.WriteByte('}')
+	case []interface{}:
+		if err := buf.WriteByte('['); err != nil {
+			return err
+		}
+		for i, v := range value {
+			if i > 0 {
+				if err := buf.WriteByte(','); err != nil {
+					return err
+				}
+			}
+			if err := writeValue(buf, v, escapeHTML); err != nil {
+				return err
+			}
+		}
+		return buf.WriteByte(']')
+	case nil:
+		_, err := buf.WriteString("null")
+		return err
+	case bool:
+		if value {
+			_, err := buf.WriteString("true")
+			return err
+		}
+		_, err := buf.WriteString("false")
+		return err
+	}
+
+	var scalar bytes.Buffer
+	enc := json.NewEncoder(&scalar)
+	enc.SetEscapeHTML(escapeHTML)
+	if err := enc.Encode(node); err != nil {
+		return err
+	}
+	_, err := buf.Write(bytes.TrimSuffix(scalar.Bytes(), []byte("\n")))
+
+	return err
+}
+
+// grow count n more bytes written, failing once they exceed the limit
+func (l *limitWriter) grow(n int) error {
+	if l.n += n; l.max > 0 && l.n > l.max {
+		return &LimitError{Limit: LimitOutputSize, Max: l.max}
+	}
+	return nil
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if err := l.grow(len(p)); err != nil {
+		return 0, err
+	}
+	if l.w == nil {
+		return len(p), nil
+	}
+	return l.w.Write(p)
+}
+
+func (l *limitWriter) WriteByte(c byte) error {
+	if err := l.grow(1); err != nil {
+		return err
+	}
+	if l.w == nil {
+		return nil
+	}
+	return l.w.WriteByte(c)
+}
+
+func (l *limitWriter) WriteString(s string) (int, error) {
+	if err := l.grow(len(s)); err != nil {
+		return 0, err
+	}
+	if l.w == nil {
+		return len(s), nil
+	}
+	return l.w.WriteString(s)
+}
@@ -0,0 +1,70 @@
+package gqldeduplicator
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecode(t *testing.T) {
+	t.Run("should keep object members in document order", func(t *testing.T) {
+		node, err := decode([]byte(`{"b":1,"a":{"d":[true,null],"c":"x"}}`))
+		assert.NoError(t, err)
+
+		root := node.(*object)
+		assert.Equal(t, []string{"b", "a"}, root.keys)
+		assert.Equal(t, []string{"d", "c"}, root.values["a"].(*object).keys)
+
+		data, err := json.Marshal(node)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"b":1,"a":{"d":[true,null],"c":"x"}}`, string(data))
+	})
+
+	t.Run("should decode empty containers", func(t *testing.T) {
+		node, err := decode([]byte(`{"a":[],"b":{}}`))
+		assert.NoError(t, err)
+
+		data, err := json.Marshal(node)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"a":[],"b":{}}`, string(data))
+	})
+
+	t.Run("should return error on invalid json", func(t *testing.T) {
+		for _, given := range []string{``, `{`, `[1,`, `{"a" 1}`, `{} {}`, `1 x`} {
+			_, err := decode([]byte(given))
+			assert.Error(t, err, given)
+		}
+	})
+}
+
+func TestRender(t *testing.T) {
+	data := []byte(`{"a": {"x": 1}, "b": [{"y": 2}], "c": "<"}`)
+	node, err := decode(data)
+	assert.NoError(t, err)
+
+	root := node.(*object)
+	a := root.values["a"].(*object)
+	b := root.values["b"].([]interface{})[0].(*object)
+	assert.Equal(t, `{"x": 1}`, string(data[a.start:a.end]))
+	assert.Equal(t, `{"y": 2}`, string(data[b.start:b.end]))
+
+	t.Run("should render edited ranges only", func(t *testing.T) {
+		stub := newObject()
+		stub.set("z", "<>")
+
+		result, err := encode(data, node, []edit{{start: a.start, end: a.end, value: stub}}, true, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"a": {"z":"<>"}, "b": [{"y": 2}], "c": "<"}`, string(result))
+
+		result, err = encode(data, node, []edit{{start: b.start, end: b.end, value: a}}, true, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"a": {"x": 1}, "b": [{"x": 1}], "c": "<"}`, string(result))
+	})
+
+	t.Run("should encode compact JSON when not verbatim", func(t *testing.T) {
+		result, err := encode(data, node, nil, false, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"a":{"x":1},"b":[{"y":2}],"c":"\u003c"}`, string(result))
+	})
+}
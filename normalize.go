@@ -0,0 +1,261 @@
+package gqldeduplicator
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+const (
+	resultField   = "result"
+	entitiesField = "entities"
+)
+
+var errNotNormalized = errors.New("normalized response must be JSON object with result and entities")
+
+type (
+	// NormalizeResult represent normalized object result, Conflicts is only reported when conflict policy is set.
+	// Stats count every reference as stub, including the one of the occurrence moved to entity table.
+	NormalizeResult struct {
+		Data      []byte
+		Conflicts []Conflict
+		Stats     Stats
+	}
+
+	normalizeState struct {
+		*deflateState
+		// tables hold entity table of every typename, keyed by entity id
+		tables *object
+	}
+)
+
+// Normalize move every entity of graphql response to entity table by id as default identifier.
+// See Deflater.Normalize.
+func Normalize(data []byte) (*NormalizeResult, error) {
+	return defaultDeflater.Normalize(data)
+}
+
+// Normalize move every entity of graphql response to entity table using deflater options and replace it with stub,
+// as in {"result":{"user":{"__typename":"User","id":1}},"entities":{"User":{"1":{"__typename":"User","id":1,"name":"foo"}}}}.
+// Entity table is keyed by typename then by id, string id is used as is, other id is JSON encoded
+// and composite id is JSON encoded list of identifier values. Entities are identified regardless of path,
+// an occurrence whose selection differs from the first one is left in place with its own entities normalized.
+// Under FormatImplicit, such occurrence carrying nothing but typename and identifier is denormalized like a stub,
+// FormatMarked keep them apart. Output is always compact JSON.
+func (d *Deflater) Normalize(data []byte) (*NormalizeResult, error) {
+	if err := d.config.validate(data, decoderDepth(d.config.maxDepth)); err != nil {
+		return nil, err
+	}
+	node, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	config := d.config
+	config.verbatim, config.global = false, true
+	s := &normalizeState{
+		deflateState: &deflateState{
+			config:  &config,
+			memoize: make(map[string]fingerprint),
+			hashes:  make(hashCache),
+		},
+		tables: newObject(),
+	}
+	result, err := s.normalize(node, newPath())
+	if err != nil {
+		return nil, err
+	}
+
+	output := newObject()
+	output.set(resultField, result)
+	output.set(entitiesField, s.tables)
+	out, err := encode(nil, output, nil, false, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	s.stats.InputSize, s.stats.OutputSize = len(data), len(out)
+	return &NormalizeResult{
+		Data:      out,
+		Conflicts: s.conflicts,
+		Stats:     s.stats,
+	}, nil
+}
+
+func (s *normalizeState) normalize(node interface{}, path *pathNode) (interface{}, error) {
+	switch value := node.(type) {
+	case []interface{}:
+		for i, v := range value {
+			child, err := s.normalize(v, path)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = child
+		}
+	case *object:
+		return s.normalizeObject(value, path)
+	}
+
+	return node, nil
+}
+
+// normalizeObject return stub of object moved to entity table, or the object itself when it is left in place
+func (s *normalizeState) normalizeObject(value *object, path *pathNode) (interface{}, error) {
+	entity, ok := s.config.entity(value, path)
+	var id string
+	if ok {
+		key, err := s.config.key(entity, path)
+		if err != nil {
+			return nil, err
+		}
+		if id, err = entityID(entity); err != nil {
+			return nil, err
+		}
+
+		memoized, found := s.memoize[key]
+		switch {
+		case found:
+			deflatable, err := s.deflatable(entity, path, memoized, newFingerprint(value, s.hashes), value.keys)
+			if err != nil {
+				return nil, err
+			}
+			if deflatable {
+				s.countStub(entity.Typename, path)
+				return s.config.stub(entity), nil
+			}
+			ok = false
+		case s.table(entity.Typename).values[id] != nil:
+			// id is taken by identifier of another JSON type, such as string "1" and number 1
+			ok = false
+		default:
+			if err := s.memoizeEntity(entity.Typename, key, newFingerprint(value, s.hashes), path); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, k := range value.keys {
+		if v := value.values[k]; isContainer(v) {
+			child, err := s.normalize(v, path.child(k))
+			if err != nil {
+				return nil, err
+			}
+			value.values[k] = child
+		}
+	}
+	if !ok {
+		return value, nil
+	}
+
+	s.table(entity.Typename).set(id, value)
+	s.config.notify(entity, path)
+	s.countStub(entity.Typename, path)
+	return s.config.stub(entity), nil
+}
+
+// table return entity table of typename, adding it when absent
+func (s *normalizeState) table(typename string) *object {
+	table, ok := s.tables.values[typename].(*object)
+	if !ok {
+		table = newObject()
+		s.tables.set(typename, table)
+	}
+	return table
+}
+
+// entityID return id of entity in entity table
+func entityID(entity Entity) (string, error) {
+	var id interface{} = entity.ID
+	if len(entity.ID) == 1 {
+		if s, ok := entity.ID[0].(string); ok {
+			return s, nil
+		}
+		id = entity.ID[0]
+	}
+
+	data, err := json.Marshal(id)
+	return string(data), err
+}
+
+// Denormalize rebuild graphql response from output of Normalize by id as identifier.
+// See Inflater.Denormalize.
+func Denormalize(data []byte) (*InflateResult, error) {
+	return defaultInflater.Denormalize(data)
+}
+
+// Denormalize rebuild graphql response from output of Normalize using inflater options,
+// every stub in result is replaced by its entity from entity table, whose own stubs are replaced as well.
+// Stub whose entity is absent, or that refer to an entity it is part of, is unresolved. Output is always compact JSON.
+func (i *Inflater) Denormalize(data []byte) (*InflateResult, error) {
+	if err := i.config.validate(data, decoderDepth(i.config.maxDepth)); err != nil {
+		return nil, err
+	}
+	node, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	root, ok := node.(*object)
+	if !ok {
+		return nil, errNotNormalized
+	}
+	result, hasResult := root.values[resultField]
+	tables, hasTables := root.values[entitiesField].(*object)
+	if !hasResult || !hasTables {
+		return nil, errNotNormalized
+	}
+
+	config := i.config
+	config.verbatim, config.global = false, true
+	s := newInflateState(&config)
+	for _, typename := range tables.keys {
+		table, ok := tables.values[typename].(*object)
+		if !ok {
+			return nil, errNotNormalized
+		}
+		if err := s.load(table); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err = s.inflate(result, s.root)
+	if err != nil {
+		return nil, err
+	}
+	out, err := encode(nil, result, nil, false, config.maxOutputSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &InflateResult{
+		Data:       out,
+		Inflated:   s.inflated,
+		Unresolved: s.unresolved,
+	}, nil
+}
+
+// load collect every entity of entity table as full object
+func (s *inflateState) load(table *object) error {
+	for _, id := range table.keys {
+		value, ok := table.values[id].(*object)
+		if !ok {
+			continue
+		}
+		entity, ok := s.config.entity(value, s.root)
+		if !ok {
+			continue
+		}
+
+		key, err := s.config.key(entity, s.root)
+		if err != nil {
+			return err
+		}
+		if err := s.config.checkEntities(len(s.entities) + 1); err != nil {
+			return err
+		}
+		s.entities[key] = value
+		s.paths[key] = s.root
+		s.globalKeys[key] = true
+	}
+
+	return nil
+}
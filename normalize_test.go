@@ -0,0 +1,88 @@
+package gqldeduplicator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Given    string
+		Options  []Option
+		Expected string
+	}{
+		{
+			Name:     "should move entities to entity table",
+			Given:    `{"post":{"__typename":"Post","id":"p1","author":{"__typename":"User","id":1,"name":"foo"},"comments":[{"__typename":"Comment","id":1,"author":{"__typename":"User","id":1,"name":"foo"}}]}}`,
+			Expected: `{"result":{"post":{"__typename":"Post","id":"p1"}},"entities":{"Post":{"p1":{"__typename":"Post","id":"p1","author":{"__typename":"User","id":1},"comments":[{"__typename":"Comment","id":1}]}},"User":{"1":{"__typename":"User","id":1,"name":"foo"}},"Comment":{"1":{"__typename":"Comment","id":1,"author":{"__typename":"User","id":1}}}}}`,
+		},
+		{
+			Name:     "should leave occurrence of different selection in place",
+			Given:    `[{"__typename":"User","id":1,"name":"foo"},{"__typename":"User","id":1,"age":1}]`,
+			Expected: `{"result":[{"__typename":"User","id":1},{"__typename":"User","id":1,"age":1}],"entities":{"User":{"1":{"__typename":"User","id":1,"name":"foo"}}}}`,
+		},
+		{
+			Name:     "should leave occurrence whose id is taken by id of another type in place",
+			Given:    `[{"__typename":"User","id":1,"name":"foo"},{"__typename":"User","id":"1","name":"bar"}]`,
+			Expected: `{"result":[{"__typename":"User","id":1},{"__typename":"User","id":"1","name":"bar"}],"entities":{"User":{"1":{"__typename":"User","id":1,"name":"foo"}}}}`,
+		},
+		{
+			Name:     "should key composite id by list of identifier values",
+			Given:    `{"repo":{"__typename":"Repository","orgId":1,"slug":"foo","name":"foo"}}`,
+			Options:  []Option{WithTypeIdentifier("Repository", "orgId", "slug")},
+			Expected: `{"result":{"repo":{"__typename":"Repository","orgId":1,"slug":"foo"}},"entities":{"Repository":{"[1,\"foo\"]":{"__typename":"Repository","orgId":1,"slug":"foo","name":"foo"}}}}`,
+		},
+		{
+			Name:     "should mark stubs",
+			Given:    `{"user":{"__typename":"User","id":1,"name":"foo"}}`,
+			Options:  []Option{WithFormat(FormatMarked)},
+			Expected: `{"result":{"user":{"__typename":"User","id":1,"__deflated":true}},"entities":{"User":{"1":{"__typename":"User","id":1,"name":"foo"}}}}`,
+		},
+		{
+			Name:     "should leave response without entity as is",
+			Given:    `{"a":[1,{"b":null}]}`,
+			Expected: `{"result":{"a":[1,{"b":null}]},"entities":{}}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			result, err := NewDeflater(test.Options...).Normalize([]byte(test.Given))
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expected, string(result.Data))
+			assert.Equal(t, len(result.Data), result.Stats.OutputSize)
+
+			denormalized, err := NewInflater(test.Options...).Denormalize(result.Data)
+			assert.NoError(t, err)
+			assert.Equal(t, test.Given, string(denormalized.Data))
+		})
+	}
+
+	t.Run("should round trip occurrence of fewer fields on marked format", func(t *testing.T) {
+		given := `[{"__typename":"User","id":1,"name":"foo"},{"__typename":"User","id":1}]`
+		result, err := NewDeflater(WithFormat(FormatMarked)).Normalize([]byte(given))
+		assert.NoError(t, err)
+
+		denormalized, err := NewInflater(WithFormat(FormatMarked)).Denormalize(result.Data)
+		assert.NoError(t, err)
+		assert.Equal(t, given, string(denormalized.Data))
+	})
+}
+
+func TestDenormalize(t *testing.T) {
+	t.Run("should report unresolved stub", func(t *testing.T) {
+		given := `{"result":[{"__typename":"User","id":1},{"__typename":"User","id":2}],"entities":{"User":{"1":{"__typename":"User","id":1,"friend":{"__typename":"User","id":1}}}}}`
+		result, err := NewInflater(WithUnresolvedPolicy(UnresolvedReport)).Denormalize([]byte(given))
+		assert.NoError(t, err)
+		assert.Equal(t, `[{"__typename":"User","id":1,"friend":{"__typename":"User","id":1}},{"__typename":"User","id":2}]`, string(result.Data))
+		assert.Len(t, result.Unresolved, 2)
+	})
+
+	t.Run("should reject input that is not normalized", func(t *testing.T) {
+		for _, given := range []string{`[]`, `{"result":{}}`, `{"result":{},"entities":[]}`, `{"result":{},"entities":{"User":[]}}`} {
+			_, err := Denormalize([]byte(given))
+			assert.Equal(t, errNotNormalized, err, given)
+		}
+	})
+}
@@ -0,0 +1,457 @@
+package gqldeduplicator
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const (
+	// FormatImplicit is format version 1, stub carry nothing but typename and identifier fields
+	FormatImplicit Format = 1
+	// FormatMarked is format version 2, stub also carry Marker set to true,
+	// so object whose query select nothing but typename and identifier fields is never mistaken for a stub
+	FormatMarked Format = 2
+	// latestFormat is the latest format version understood, later versions are rejected on inflate
+	latestFormat = FormatMarked
+
+	// Marker is the field set to true on stub of FormatMarked
+	Marker = "__deflated"
+
+	defaultIdentifier    = "id"
+	defaultTypenameField = "__typename"
+	// defaultMaxDepth match nesting limit of encoding/json
+	defaultMaxDepth = 10000
+)
+
+type (
+	// Option configure Deflater and Inflater
+	Option func(*config)
+
+	// Format represent wire format version of deflated output
+	Format int
+
+	// Path represent field names leading to an object, list indexes are not part of the path
+	Path []string
+
+	// Entity represent object identified by its typename and identifier fields.
+	// ID hold value of every field in Identifiers, in the same order.
+	// Path is only set on entity seen by rules, hooks, conflicts and unresolved reports.
+	Entity struct {
+		Path        Path
+		Typename    string
+		Identifiers []string
+		ID          []interface{}
+	}
+
+	// Rule report whether entity should take part in deduplication
+	Rule func(entity Entity) bool
+
+	// Hook is called for every entity replaced by a stub on deflate or by the full object on inflate
+	Hook func(entity Entity)
+
+	config struct {
+		identifiers      []string
+		typeIdentifiers  map[string][]string
+		global           bool
+		globalTypes      map[string]bool
+		typenameField    string
+		format           Format
+		verbatim         bool
+		copyOnWrite      bool
+		conflictPolicy   ConflictPolicy
+		unresolvedPolicy UnresolvedPolicy
+		minSaving        int
+		minSavingRatio   float64
+		maxDepth         int
+		maxInputSize     int
+		maxEntities      int
+		maxOutputSize    int
+		rules            []Rule
+		hooks            []Hook
+	}
+)
+
+// WithIdentifier set fallback identifier fields used for typename without WithTypeIdentifier, default is id.
+// The first field present in object is used as its identifier.
+func WithIdentifier(fields ...string) Option {
+	return func(c *config) {
+		c.identifiers = fields
+	}
+}
+
+// WithTypeIdentifier set identifier fields of typename.
+// Every field must be present in object and together they form a composite key.
+func WithTypeIdentifier(typename string, fields ...string) Option {
+	return func(c *config) {
+		c.typeIdentifiers[typename] = fields
+	}
+}
+
+// WithGlobalIdentity deduplicate entities of every typename across paths, for schema whose identifiers are unique
+// within typename wherever it appears, such as Relay Node. By default an entity is only deduplicated at the same path.
+func WithGlobalIdentity() Option {
+	return func(c *config) {
+		c.global = true
+	}
+}
+
+// WithGlobalType deduplicate entities of typenames across paths, see WithGlobalIdentity
+func WithGlobalType(typenames ...string) Option {
+	return func(c *config) {
+		for _, typename := range typenames {
+			c.globalTypes[typename] = true
+		}
+	}
+}
+
+// WithTypenameField set typename field, default is __typename
+func WithTypenameField(field string) Option {
+	return func(c *config) {
+		c.typenameField = field
+	}
+}
+
+// WithFormat set wire format version of deflated output, default is FormatImplicit that every client understand.
+// Inflater only substitute objects carrying Marker under FormatMarked. Marked stub may be larger than the object
+// it replaces, Deflate still return it unless WithMinSaving or WithMinSavingRatio is set.
+func WithFormat(format Format) Option {
+	return func(c *config) {
+		c.format = format
+	}
+}
+
+// WithVerbatimOutput copy input to output as is, only deflated or inflated objects are changed.
+// Key order, whitespace, string escaping and number format outside of those objects are preserved.
+func WithVerbatimOutput() Option {
+	return func(c *config) {
+		c.verbatim = true
+	}
+}
+
+// WithCopyOnWrite make DeflateValue and InflateValue leave given value untouched.
+// Only maps and lists on the way to a replaced object are copied, everything else is shared with the given value.
+func WithCopyOnWrite() Option {
+	return func(c *config) {
+		c.copyOnWrite = true
+	}
+}
+
+// WithMinSaving make Deflate return its input as is with Deflated false when stubs save less than bytes.
+// Saving is measured against output without stubs, whitespace removed from compact output does not count.
+// It has no effect on DeflateStream and DeflateValue.
+func WithMinSaving(bytes int) Option {
+	return func(c *config) {
+		c.minSaving = bytes
+	}
+}
+
+// WithMinSavingRatio make Deflate return its input as is with Deflated false when stubs save less than ratio,
+// between 0 and 1, of output without stubs. It has no effect on DeflateStream and DeflateValue.
+func WithMinSavingRatio(ratio float64) Option {
+	return func(c *config) {
+		c.minSavingRatio = ratio
+	}
+}
+
+// WithMaxDepth limit nesting depth of objects and lists, default is 10000 as in encoding/json.
+// Zero disable the limit, which let deeply nested input exhaust goroutine stack.
+// Streams, Inflate, Normalize and Denormalize are still limited to 10000, the limit of encoding/json decoder,
+// which is reported as *LimitError as well.
+func WithMaxDepth(depth int) Option {
+	return func(c *config) {
+		c.maxDepth = depth
+	}
+}
+
+// WithMaxInputSize limit input size in bytes, default is zero which disable the limit
+func WithMaxInputSize(bytes int) Option {
+	return func(c *config) {
+		c.maxInputSize = bytes
+	}
+}
+
+// WithMaxEntities limit number of distinct entities memoized on deflate or collected on inflate,
+// default is zero which disable the limit
+func WithMaxEntities(entities int) Option {
+	return func(c *config) {
+		c.maxEntities = entities
+	}
+}
+
+// WithMaxOutputSize limit inflated output size in bytes, so that few stubs referring to large entities cannot
+// blow up memory of Inflate, InflateResponse, InflateStream, InflateInto and Denormalize. Default is zero
+// which disable the limit, except on Transport which limit it to 64 MiB unless it is negative.
+func WithMaxOutputSize(bytes int) Option {
+	return func(c *config) {
+		c.maxOutputSize = bytes
+	}
+}
+
+// WithConflictPolicy detect duplicate entity whose field values differ from the first occurrence and handle it by policy,
+// default is ConflictIgnore which does not compare field values
+func WithConflictPolicy(policy ConflictPolicy) Option {
+	return func(c *config) {
+		c.conflictPolicy = policy
+	}
+}
+
+// WithUnresolvedPolicy handle object that looks like a stub but whose full object is not found on inflate by policy,
+// default is UnresolvedIgnore which leave it as is. Only stubs of deflated output are unresolved,
+// unless the query itself select nothing but typename and identifier fields of an object.
+func WithUnresolvedPolicy(policy UnresolvedPolicy) Option {
+	return func(c *config) {
+		c.unresolvedPolicy = policy
+	}
+}
+
+// WithRule add rule to decide which entities are deduplicated, entity is deduplicated only when every rule allow it
+func WithRule(rule Rule) Option {
+	return func(c *config) {
+		c.rules = append(c.rules, rule)
+	}
+}
+
+// WithHook add hook called for every deflated or inflated entity
+func WithHook(hook Hook) Option {
+	return func(c *config) {
+		c.hooks = append(c.hooks, hook)
+	}
+}
+
+// at return entity with Path set to path, Path is only built for entity seen by the caller
+func (e Entity) at(path *pathNode) Entity {
+	if e.Path == nil {
+		e.Path = path.fields()
+	}
+	return e
+}
+
+// String return path joined by dot
+func (p Path) String() string {
+	return strings.Join(p, ".")
+}
+
+type (
+	// pathNode is path linked to its parent, so descending into a field costs the same at any depth.
+	// Nodes of equal path share id within one run, the id stand for the path in memoize keys.
+	pathNode struct {
+		parent *pathNode
+		field  string
+		id     int
+		index  *pathIndex
+	}
+
+	// pathIndex intern paths of one run, names cache path of node id joined by dot
+	pathIndex struct {
+		ids   map[pathEdge]int
+		names map[int]string
+	}
+
+	pathEdge struct {
+		parent int
+		field  string
+	}
+)
+
+// newPath return root path of a new run
+func newPath() *pathNode {
+	return &pathNode{index: &pathIndex{ids: make(map[pathEdge]int)}}
+}
+
+// child return path with field appended, the receiver is never modified
+func (p *pathNode) child(field string) *pathNode {
+	edge := pathEdge{parent: p.id, field: field}
+	id, ok := p.index.ids[edge]
+	if !ok {
+		id = len(p.index.ids) + 1
+		p.index.ids[edge] = id
+	}
+
+	return &pathNode{parent: p, field: field, id: id, index: p.index}
+}
+
+// fields return path from the root, nil at the root or without path
+func (p *pathNode) fields() Path {
+	if p == nil {
+		return nil
+	}
+
+	n := 0
+	for q := p; q.parent != nil; q = q.parent {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+
+	path := make(Path, n)
+	for q := p; q.parent != nil; q = q.parent {
+		n--
+		path[n] = q.field
+	}
+	return path
+}
+
+// String return path joined by dot, cached by id
+func (p *pathNode) String() string {
+	if name, ok := p.index.names[p.id]; ok {
+		return name
+	}
+
+	if p.index.names == nil {
+		p.index.names = make(map[int]string)
+	}
+	name := p.fields().String()
+	p.index.names[p.id] = name
+	return name
+}
+
+func newConfig(opts []Option) config {
+	c := config{
+		identifiers:     []string{defaultIdentifier},
+		typeIdentifiers: make(map[string][]string),
+		globalTypes:     make(map[string]bool),
+		typenameField:   defaultTypenameField,
+		format:          FormatImplicit,
+		maxDepth:        defaultMaxDepth,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	return c
+}
+
+// entity return entity represented by object, ok is false when object has no typename or identifier
+// or when it is excluded by rules
+func (c *config) entity(value *object, path *pathNode) (entity Entity, ok bool) {
+	typename, ok := value.values[c.typenameField].(string)
+	if !ok {
+		return Entity{}, false
+	}
+
+	entity = Entity{Typename: typename}
+	if fields, ok := c.typeIdentifiers[typename]; ok {
+		for _, field := range fields {
+			if value.values[field] == nil {
+				return Entity{}, false
+			}
+		}
+		entity.Identifiers = fields
+	} else {
+		for _, field := range c.identifiers {
+			if value.values[field] != nil {
+				entity.Identifiers = []string{field}
+				break
+			}
+		}
+	}
+	if len(entity.Identifiers) == 0 {
+		return Entity{}, false
+	}
+
+	entity.ID = make([]interface{}, len(entity.Identifiers))
+	for i, field := range entity.Identifiers {
+		entity.ID[i] = value.values[field]
+	}
+	if len(c.rules) > 0 {
+		entity.Path = path.fields()
+	}
+	for _, rule := range c.rules {
+		if !rule(entity) {
+			return Entity{}, false
+		}
+	}
+
+	return entity, true
+}
+
+// key return memoize key of entity. The key is JSON encoded so field names are escaped
+// and identifier keep its JSON type, string "1" and number 1 never share a key.
+// Identifier fields are part of the key since fallback identifiers may differ between objects of the same typename.
+// Path stand in the key by its id at path, it is left out of the key of global typename.
+func (c *config) key(entity Entity, path *pathNode) (string, error) {
+	var id interface{}
+	if path != nil && !c.isGlobal(entity.Typename) {
+		id = path.id
+	}
+
+	key, err := json.Marshal([]interface{}{id, entity.Typename, entity.Identifiers, entity.ID})
+	if err != nil {
+		return "", err
+	}
+
+	return string(key), nil
+}
+
+// isGlobal check whether entities of typename are deduplicated across paths
+func (c *config) isGlobal(typename string) bool {
+	return c.global || c.globalTypes[typename]
+}
+
+// hasGlobal check whether entities of any typename are deduplicated across paths
+func (c *config) hasGlobal() bool {
+	return c.global || len(c.globalTypes) > 0
+}
+
+// stub return object carrying nothing but typename and identifier fields of entity, along with Marker on FormatMarked
+func (c *config) stub(entity Entity) *object {
+	stub := newObject()
+	stub.set(c.typenameField, entity.Typename)
+	for i, field := range entity.Identifiers {
+		stub.set(field, entity.ID[i])
+	}
+	if c.format == FormatMarked {
+		stub.set(Marker, true)
+	}
+	return stub
+}
+
+// isStub check whether object of entity is produced by stub, it carry nothing but typename and identifier
+// or it carry Marker on FormatMarked
+func (c *config) isStub(value *object, entity Entity) bool {
+	if c.format == FormatMarked {
+		return value.values[Marker] == true
+	}
+	return len(value.keys) == len(entity.Identifiers)+1
+}
+
+// validate check that data is valid JSON within input size limit and nested at most maxDepth deep,
+// unless maxDepth is zero
+func (c *config) validate(data []byte, maxDepth int) error {
+	if c.maxInputSize > 0 && len(data) > c.maxInputSize {
+		return &LimitError{Limit: LimitInputSize, Max: c.maxInputSize}
+	}
+
+	s := scanner{data: data}
+	return s.validate(maxDepth)
+}
+
+// checkEntities check that n entities are within entities limit
+func (c *config) checkEntities(n int) error {
+	if c.maxEntities > 0 && n > c.maxEntities {
+		return &LimitError{Limit: LimitEntities, Max: c.maxEntities}
+	}
+	return nil
+}
+
+// worthSaving check whether saving bytes out of output that would be written without stubs meets minimum saving.
+// Saving is not checked unless minimum saving is set, since marked stub may be larger than the object it replaces.
+func (c *config) worthSaving(saving, output int) bool {
+	if c.minSaving <= 0 && c.minSavingRatio <= 0 {
+		return true
+	}
+
+	return saving >= c.minSaving && float64(saving) >= c.minSavingRatio*float64(output)
+}
+
+func (c *config) notify(entity Entity, path *pathNode) {
+	if len(c.hooks) == 0 {
+		return
+	}
+
+	entity = entity.at(path)
+	for _, hook := range c.hooks {
+		hook(entity)
+	}
+}
@@ -0,0 +1,516 @@
+package gqldeduplicator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPath(t *testing.T) {
+	t.Run("should join path by dot", func(t *testing.T) {
+		assert.Equal(t, "root.child", Path{"root", "child"}.String())
+		assert.Equal(t, "", Path(nil).String())
+	})
+
+	t.Run("should not modify parent path", func(t *testing.T) {
+		parent := newPath().child("root")
+
+		first := parent.child("first")
+		second := parent.child("second")
+		assert.Equal(t, Path{"root", "first"}, first.fields())
+		assert.Equal(t, Path{"root", "second"}, second.fields())
+		assert.Equal(t, Path{"root"}, parent.fields())
+		assert.Equal(t, "root.first", first.String())
+	})
+
+	t.Run("should share id between equal paths only", func(t *testing.T) {
+		root := newPath()
+
+		assert.Equal(t, root.child("a").child("b").id, root.child("a").child("b").id)
+		assert.NotEqual(t, root.child("a").child("b").id, root.child("b").child("a").id)
+		assert.NotEqual(t, root.child("a.b").id, root.child("a").child("b").id)
+		assert.NotEqual(t, root.id, root.child("").id)
+		assert.Nil(t, root.fields())
+	})
+}
+
+// pathOf return node of path under root
+func pathOf(root *pathNode, path Path) *pathNode {
+	node := root
+	for _, field := range path {
+		node = node.child(field)
+	}
+	return node
+}
+
+func TestKey(t *testing.T) {
+	c := newConfig(nil)
+	entities := []Entity{
+		{Path: Path{"root"}, Typename: "foo", ID: []interface{}{"1"}},
+		{Path: Path{"root"}, Typename: "foo", ID: []interface{}{float64(1)}},
+		{Path: Path{"root"}, Typename: "foo", ID: []interface{}{true}},
+		{Path: Path{"root"}, Typename: "foo", ID: []interface{}{"true"}},
+		{Path: Path{"root"}, Typename: "foo", ID: []interface{}{"1", "2"}},
+		{Path: Path{"root"}, Typename: "foo", ID: []interface{}{"1,2"}},
+		{Path: Path{"root", "a"}, Typename: "foo", ID: []interface{}{"1"}},
+		{Path: Path{"root,a"}, Typename: "foo", ID: []interface{}{"1"}},
+		{Path: Path{"root"}, Typename: "a,foo", ID: []interface{}{"1"}},
+		{Path: Path{"root"}, Typename: "foo", ID: []interface{}{"1"}, Identifiers: []string{"uuid"}},
+	}
+
+	t.Run("should never share key between distinct entities", func(t *testing.T) {
+		root := newPath()
+		keys := make(map[string]int)
+		for i, entity := range entities {
+			key, err := c.key(entity, pathOf(root, entity.Path))
+			assert.NoError(t, err)
+			if j, ok := keys[key]; ok {
+				assert.Failf(t, "key collision", "%v and %v share key %s", entities[j], entity, key)
+			}
+			keys[key] = i
+		}
+		assert.Len(t, keys, len(entities))
+	})
+}
+
+func TestPathCost(t *testing.T) {
+	deflater, inflater := NewDeflater(), NewInflater()
+	for _, test := range []struct {
+		Name string
+		Run  func(data []byte) error
+	}{
+		{Name: "Deflate", Run: func(data []byte) error {
+			_, err := deflater.Deflate(data)
+			return err
+		}},
+		{Name: "DeflateStream", Run: func(data []byte) error {
+			_, err := deflater.DeflateStream(bytes.NewReader(data), ioutil.Discard)
+			return err
+		}},
+		{Name: "Normalize", Run: func(data []byte) error {
+			_, err := deflater.Normalize(data)
+			return err
+		}},
+		{Name: "Inflate", Run: func(data []byte) error {
+			_, err := inflater.Inflate(data)
+			return err
+		}},
+		{Name: "InflateStream", Run: func(data []byte) error {
+			_, err := inflater.InflateStream(bytes.NewReader(data), ioutil.Discard)
+			return err
+		}},
+		{Name: "InflateInto", Run: func(data []byte) error {
+			var dst interface{}
+			return inflater.InflateInto(data, &dst)
+		}},
+	} {
+		t.Run(test.Name+" should allocate linearly with depth", func(t *testing.T) {
+			allocated := func(depth int) uint64 {
+				data := nestedResponse(depth, true)
+				var before, after runtime.MemStats
+				runtime.ReadMemStats(&before)
+				assert.NoError(t, test.Run(data))
+				runtime.ReadMemStats(&after)
+				return after.TotalAlloc - before.TotalAlloc
+			}
+
+			// quadratic cost allocate 16 times as much for 4 times the depth
+			shallow, deep := allocated(1000), allocated(4000)
+			assert.Less(t, deep, 8*shallow, "%d bytes at depth 1000, %d bytes at depth 4000", shallow, deep)
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	nested := func(depth int) string {
+		return strings.Repeat(`{"a":`, depth-1) + `[]` + strings.Repeat(`}`, depth-1)
+	}
+	entities := `[{"__typename":"foo","id":1,"name":"a"},{"__typename":"foo","id":2,"name":"b"},{"__typename":"foo","id":2}]`
+
+	run := map[string]func(opts []Option, data string) error{
+		"Deflate": func(opts []Option, data string) error {
+			_, err := NewDeflater(opts...).Deflate([]byte(data))
+			return err
+		},
+		"Inflate": func(opts []Option, data string) error {
+			_, err := NewInflater(opts...).Inflate([]byte(data))
+			return err
+		},
+		"DeflateStream": func(opts []Option, data string) error {
+			_, err := NewDeflater(opts...).DeflateStream(strings.NewReader(data), &bytes.Buffer{})
+			return err
+		},
+		"InflateStream": func(opts []Option, data string) error {
+			_, err := NewInflater(opts...).InflateStream(strings.NewReader(data), &bytes.Buffer{})
+			return err
+		},
+	}
+
+	tests := []struct {
+		Name     string
+		Given    string
+		Options  []Option
+		Expected *LimitError
+	}{
+		{
+			Name:    "should accept nesting at max depth",
+			Given:   nested(3),
+			Options: []Option{WithMaxDepth(3)},
+		},
+		{
+			Name:     "should reject nesting beyond max depth",
+			Given:    nested(4),
+			Options:  []Option{WithMaxDepth(3)},
+			Expected: &LimitError{Limit: LimitDepth, Max: 3},
+		},
+		{
+			Name:    "should accept input at max size",
+			Given:   `{"a":1}`,
+			Options: []Option{WithMaxInputSize(7)},
+		},
+		{
+			Name:     "should reject input beyond max size",
+			Given:    `{"a":12}`,
+			Options:  []Option{WithMaxInputSize(7)},
+			Expected: &LimitError{Limit: LimitInputSize, Max: 7},
+		},
+		{
+			Name:    "should accept entities at max entities",
+			Given:   entities,
+			Options: []Option{WithMaxEntities(2)},
+		},
+		{
+			Name:     "should reject entities beyond max entities",
+			Given:    entities,
+			Options:  []Option{WithMaxEntities(1)},
+			Expected: &LimitError{Limit: LimitEntities, Max: 1},
+		},
+	}
+	for _, test := range tests {
+		for name, f := range run {
+			t.Run(name+" "+test.Name, func(t *testing.T) {
+				err := f(test.Options, test.Given)
+				if test.Expected == nil {
+					assert.NoError(t, err)
+					return
+				}
+
+				var limit *LimitError
+				if assert.True(t, errors.As(err, &limit), "%v", err) {
+					assert.Equal(t, test.Expected, limit)
+				}
+			})
+		}
+	}
+
+	t.Run("should reject deep nesting by default without exhausting stack", func(t *testing.T) {
+		given := []byte(nested(100000))
+		_, err := Deflate(given)
+		assert.Equal(t, &LimitError{Limit: LimitDepth, Max: 10000}, err)
+		_, err = Inflate(given)
+		assert.Equal(t, &LimitError{Limit: LimitDepth, Max: 10000}, err)
+	})
+
+	t.Run("should reject deep stream beyond encoding/json limit even without max depth", func(t *testing.T) {
+		given := strings.Repeat(`[`, 10001) + strings.Repeat(`]`, 10001)
+		_, err := NewDeflater(WithMaxDepth(0)).DeflateStream(strings.NewReader(given), &bytes.Buffer{})
+		assert.Equal(t, &LimitError{Limit: LimitDepth, Max: 10000}, err)
+		_, err = NewInflater(WithMaxDepth(0)).InflateStream(strings.NewReader(given), &bytes.Buffer{})
+		assert.Equal(t, &LimitError{Limit: LimitDepth, Max: 10000}, err)
+	})
+
+	t.Run("should reject decoded document beyond encoding/json limit even without max depth", func(t *testing.T) {
+		given := []byte(strings.Repeat(`[`, 10001) + strings.Repeat(`]`, 10001))
+		inflater := NewInflater(WithMaxDepth(0))
+		_, err := inflater.Inflate(given)
+		assert.Equal(t, &LimitError{Limit: LimitDepth, Max: 10000}, err)
+		_, err = inflater.Denormalize(given)
+		assert.Equal(t, &LimitError{Limit: LimitDepth, Max: 10000}, err)
+		_, err = NewDeflater(WithMaxDepth(0)).Normalize(given)
+		assert.Equal(t, &LimitError{Limit: LimitDepth, Max: 10000}, err)
+		_, err = NewDeflater(WithMaxDepth(0)).Deflate(given)
+		assert.NoError(t, err)
+	})
+
+	t.Run("should not count brackets in strings toward stream depth", func(t *testing.T) {
+		given := strings.Repeat(`[`, 10000) + `"[{\"[{"` + strings.Repeat(`]`, 10000)
+		var buf bytes.Buffer
+		_, err := NewDeflater(WithMaxDepth(0)).DeflateStream(strings.NewReader(given), &buf)
+		assert.NoError(t, err)
+		assert.Equal(t, given, buf.String())
+		buf.Reset()
+		_, err = NewInflater(WithMaxDepth(0)).InflateStream(strings.NewReader(given), &buf)
+		assert.NoError(t, err)
+		assert.Equal(t, given, buf.String())
+	})
+
+	t.Run("should reject deep value", func(t *testing.T) {
+		var value interface{} = []interface{}{}
+		for i := 0; i < 3; i++ {
+			value = map[string]interface{}{"a": value}
+		}
+
+		_, err := NewDeflater(WithMaxDepth(3)).DeflateValue(value)
+		assert.Equal(t, &LimitError{Limit: LimitDepth, Max: 3}, err)
+		_, err = NewInflater(WithMaxDepth(3)).InflateValue(value)
+		assert.Equal(t, &LimitError{Limit: LimitDepth, Max: 3}, err)
+		_, err = NewInflater(WithMaxDepth(4)).InflateValue(value)
+		assert.NoError(t, err)
+	})
+}
+
+func TestMaxOutputSize(t *testing.T) {
+	given := `{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1},{"__typename":"foo","id":1}]}`
+	expected := `{"a":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"foo"}]}`
+
+	// run inflate given with output limited to max bytes more than expected output
+	run := map[string]func(max int) error{
+		"Inflate": func(max int) error {
+			_, err := NewInflater(WithMaxOutputSize(len(expected) + max)).Inflate([]byte(given))
+			return err
+		},
+		"InflateResponse": func(max int) error {
+			response := `{"data":` + given + `,"extensions":{"deduplicator":{}}}`
+			_, err := NewInflater(WithMaxOutputSize(len(`{"data":}`) + len(expected) + max)).InflateResponse([]byte(response))
+			return err
+		},
+		"InflateStream": func(max int) error {
+			_, err := NewInflater(WithMaxOutputSize(len(expected)+max)).InflateStream(strings.NewReader(given), &bytes.Buffer{})
+			return err
+		},
+		"InflateInto": func(max int) error {
+			var v interface{}
+			return NewInflater(WithMaxOutputSize(len(expected)+max)).InflateInto([]byte(given), &v)
+		},
+	}
+
+	tests := []struct {
+		Name     string
+		Given    int
+		Expected bool
+	}{
+		{
+			Name:  "should accept output at max size",
+			Given: 0,
+		},
+		{
+			Name:     "should reject output beyond max size",
+			Given:    -1,
+			Expected: true,
+		},
+	}
+	for _, test := range tests {
+		for name, f := range run {
+			t.Run(name+" "+test.Name, func(t *testing.T) {
+				err := f(test.Given)
+				if !test.Expected {
+					assert.NoError(t, err)
+					return
+				}
+
+				var limit *LimitError
+				if assert.True(t, errors.As(err, &limit), "%v", err) {
+					assert.Equal(t, LimitOutputSize, limit.Limit)
+				}
+			})
+		}
+	}
+
+	t.Run("should stop on output blown up by nested stubs", func(t *testing.T) {
+		// every level refer to the level below twice, so output double at each level
+		var buf strings.Builder
+		buf.WriteString(`[{"__typename":"L","id":0,"v":"x"}`)
+		for i := 1; i <= 64; i++ {
+			fmt.Fprintf(&buf, `,{"__typename":"L","id":%d,"v":[{"__typename":"L","id":%d},{"__typename":"L","id":%d}]}`, i, i-1, i-1)
+		}
+		buf.WriteString(`]`)
+
+		_, err := NewInflater(WithGlobalType("L"), WithMaxOutputSize(1<<20)).Inflate([]byte(buf.String()))
+		assert.Equal(t, &LimitError{Limit: LimitOutputSize, Max: 1 << 20}, err)
+	})
+}
+
+func TestFormat(t *testing.T) {
+	given := `{"a":[{"__typename":"foo","id":1,"name":"foo bar baz"},{"__typename":"foo","id":1,"name":"foo bar baz"}],"b":{"__typename":"bar","id":2}}`
+	deflated := `{"a":[{"__typename":"foo","id":1,"name":"foo bar baz"},{"__typename":"foo","id":1,"__deflated":true}],"b":{"__typename":"bar","id":2}}`
+
+	t.Run("should mark stub", func(t *testing.T) {
+		deflater := NewDeflater(WithFormat(FormatMarked))
+		result, err := deflater.Deflate([]byte(given))
+		assert.NoError(t, err)
+		assert.Equal(t, deflated, string(result.Data))
+
+		var buf bytes.Buffer
+		_, err = deflater.DeflateStream(strings.NewReader(given), &buf)
+		assert.NoError(t, err)
+		assert.Equal(t, deflated, buf.String())
+	})
+
+	t.Run("should mark stub larger than its object", func(t *testing.T) {
+		given := `[{"__typename":"foo","id":1},{"__typename":"foo","id":1}]`
+		expected := `[{"__typename":"foo","id":1},{"__typename":"foo","id":1,"__deflated":true}]`
+
+		deflater := NewDeflater(WithFormat(FormatMarked))
+		result, err := deflater.Deflate([]byte(given))
+		assert.NoError(t, err)
+		assert.True(t, result.Deflated)
+		assert.Equal(t, expected, string(result.Data))
+
+		var buf bytes.Buffer
+		_, err = deflater.DeflateStream(strings.NewReader(given), &buf)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, buf.String())
+
+		result, err = NewDeflater(WithFormat(FormatMarked), WithMinSaving(1)).Deflate([]byte(given))
+		assert.NoError(t, err)
+		assert.False(t, result.Deflated)
+		assert.Equal(t, given, string(result.Data))
+	})
+
+	t.Run("should only inflate marked stub", func(t *testing.T) {
+		given := `{"a":[{"__typename":"foo","id":1,"name":"foo bar baz"},{"__typename":"foo","id":1,"__deflated":true},{"__typename":"foo","id":1}]}`
+		expected := `{"a":[{"__typename":"foo","id":1,"name":"foo bar baz"},{"__typename":"foo","id":1,"name":"foo bar baz"},{"__typename":"foo","id":1}]}`
+
+		inflater := NewInflater(WithFormat(FormatMarked), WithUnresolvedPolicy(UnresolvedFail))
+		result, err := inflater.Inflate([]byte(given))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(result.Data))
+
+		var buf bytes.Buffer
+		_, err = inflater.InflateStream(strings.NewReader(given), &buf)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, buf.String())
+	})
+
+	t.Run("should round trip", func(t *testing.T) {
+		deflate, err := NewDeflater(WithFormat(FormatMarked)).Deflate([]byte(given))
+		assert.NoError(t, err)
+
+		inflate, err := NewInflater(WithFormat(FormatMarked), WithUnresolvedPolicy(UnresolvedFail)).Inflate(deflate.Data)
+		assert.NoError(t, err)
+		assert.Equal(t, given, string(inflate.Data))
+	})
+}
+
+func TestGlobal(t *testing.T) {
+	given := `{"author":{"__typename":"User","id":1,"name":"foo"},"comments":[{"__typename":"Comment","id":1,"author":{"__typename":"User","id":1,"name":"foo"}},{"__typename":"Comment","id":2,"author":{"__typename":"User","id":1,"name":"foo"}}]}`
+	global := `{"author":{"__typename":"User","id":1,"name":"foo"},"comments":[{"__typename":"Comment","id":1,"author":{"__typename":"User","id":1}},{"__typename":"Comment","id":2,"author":{"__typename":"User","id":1}}]}`
+	byPath := `{"author":{"__typename":"User","id":1,"name":"foo"},"comments":[{"__typename":"Comment","id":1,"author":{"__typename":"User","id":1,"name":"foo"}},{"__typename":"Comment","id":2,"author":{"__typename":"User","id":1}}]}`
+
+	deflate := map[string]func(opts []Option, data string) (string, error){
+		"Deflate": func(opts []Option, data string) (string, error) {
+			result, err := NewDeflater(opts...).Deflate([]byte(data))
+			if err != nil {
+				return "", err
+			}
+			return string(result.Data), nil
+		},
+		"DeflateStream": func(opts []Option, data string) (string, error) {
+			var buf bytes.Buffer
+			_, err := NewDeflater(opts...).DeflateStream(strings.NewReader(data), &buf)
+			return buf.String(), err
+		},
+		"deflateTree": func(opts []Option, data string) (string, error) {
+			result, err := deflateTree(NewDeflater(opts...), []byte(data))
+			return string(result), err
+		},
+	}
+	inflate := map[string]func(opts []Option, data string) (string, error){
+		"Inflate": func(opts []Option, data string) (string, error) {
+			result, err := NewInflater(opts...).Inflate([]byte(data))
+			if err != nil {
+				return "", err
+			}
+			return string(result.Data), nil
+		},
+		"Inflate verbatim": func(opts []Option, data string) (string, error) {
+			result, err := NewInflater(append(opts, WithVerbatimOutput())...).Inflate([]byte(data))
+			if err != nil {
+				return "", err
+			}
+			return string(result.Data), nil
+		},
+		"Inflate copy on write": func(opts []Option, data string) (string, error) {
+			result, err := NewInflater(append(opts, WithCopyOnWrite())...).Inflate([]byte(data))
+			if err != nil {
+				return "", err
+			}
+			return string(result.Data), nil
+		},
+		"InflateStream": func(opts []Option, data string) (string, error) {
+			var buf bytes.Buffer
+			_, err := NewInflater(opts...).InflateStream(strings.NewReader(data), &buf)
+			return buf.String(), err
+		},
+	}
+
+	tests := []struct {
+		Name     string
+		Options  []Option
+		Expected string
+	}{
+		{
+			Name:     "should deduplicate by path by default",
+			Expected: byPath,
+		},
+		{
+			Name:     "should deduplicate global type across paths",
+			Options:  []Option{WithGlobalType("User")},
+			Expected: global,
+		},
+		{
+			Name:     "should deduplicate every type across paths",
+			Options:  []Option{WithGlobalIdentity()},
+			Expected: global,
+		},
+	}
+	for _, test := range tests {
+		for name, f := range deflate {
+			t.Run(name+" "+test.Name, func(t *testing.T) {
+				result, err := f(test.Options, given)
+				assert.NoError(t, err)
+				assert.Equal(t, test.Expected, result)
+			})
+		}
+		for name, f := range inflate {
+			t.Run(name+" "+test.Name, func(t *testing.T) {
+				result, err := f(test.Options, test.Expected)
+				assert.NoError(t, err)
+				assert.Equal(t, given, result)
+			})
+		}
+	}
+
+	t.Run("should inflate stub before its full object", func(t *testing.T) {
+		given := `{"a":{"__typename":"User","id":1},"b":{"__typename":"User","id":1,"friend":{"__typename":"User","id":2}},"c":[{"__typename":"User","id":2,"name":"bar"}]}`
+		expected := `{"a":{"__typename":"User","id":1,"friend":{"__typename":"User","id":2,"name":"bar"}},"b":{"__typename":"User","id":1,"friend":{"__typename":"User","id":2,"name":"bar"}},"c":[{"__typename":"User","id":2,"name":"bar"}]}`
+		for _, opts := range [][]Option{
+			{WithGlobalIdentity()},
+			{WithGlobalIdentity(), WithVerbatimOutput()},
+			{WithGlobalIdentity(), WithCopyOnWrite()},
+		} {
+			result, err := NewInflater(opts...).Inflate([]byte(given))
+			assert.NoError(t, err)
+			assert.Equal(t, expected, string(result.Data))
+		}
+	})
+
+	t.Run("should leave stub referring its ancestor unresolved", func(t *testing.T) {
+		given := `[{"__typename":"User","id":1,"friend":{"__typename":"User","id":2}},{"__typename":"User","id":2,"friend":{"__typename":"User","id":1}}]`
+		for _, opts := range [][]Option{
+			{WithGlobalIdentity()},
+			{WithGlobalIdentity(), WithVerbatimOutput()},
+			{WithGlobalIdentity(), WithCopyOnWrite()},
+		} {
+			result, err := NewInflater(append(opts, WithUnresolvedPolicy(UnresolvedReport))...).Inflate([]byte(given))
+			assert.NoError(t, err)
+			assert.Len(t, result.Unresolved, 1)
+		}
+	})
+}
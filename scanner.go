@@ -0,0 +1,846 @@
+package gqldeduplicator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+type (
+	// scanner validate and walk JSON document in place, without decoding it
+	scanner struct {
+		data []byte
+		// containers hold span of every object and list sorted by start once indexed,
+		// so skipping a nested value does not scan it again at every level above it
+		containers []span
+	}
+
+	// span locate value in document, from its first byte to right after its last byte
+	span struct {
+		start, end int
+	}
+
+	// hashed is cached hash of object or list along with its end
+	hashed struct {
+		hash valueHash
+		end  int
+	}
+
+	// member locate object member in document, key and value span from their first byte to right after their last byte
+	member struct {
+		key, keyEnd     int
+		value, valueEnd int
+	}
+)
+
+// validate check that data hold exactly one valid JSON value nested at most maxDepth deep, unless maxDepth is zero.
+// Nesting is tracked by explicit stack, so deep input can not overflow goroutine stack.
+func (s *scanner) validate(maxDepth int) error {
+	var stack []byte // closing byte of every open container
+	i := s.skipSpace(0)
+	for {
+		var err error
+		if i >= len(s.data) {
+			return s.unexpectedEnd()
+		}
+
+		switch s.data[i] {
+		case '{', '[':
+			if maxDepth > 0 && len(stack) == maxDepth {
+				return &LimitError{Limit: LimitDepth, Max: maxDepth}
+			}
+
+			closing := s.data[i] + 2 // '{' + 2 is '}' and '[' + 2 is ']'
+			if i = s.skipSpace(i + 1); i < len(s.data) && s.data[i] == closing {
+				i++
+				break
+			}
+			stack = append(stack, closing)
+			if closing == '}' {
+				if i, err = s.checkKey(i); err != nil {
+					return err
+				}
+			}
+			continue
+		default:
+			if i, err = s.checkScalar(i); err != nil {
+				return err
+			}
+		}
+
+		// value ends at i, close every finished container and move to the next value
+		for {
+			i = s.skipSpace(i)
+			if len(stack) == 0 {
+				if i < len(s.data) {
+					return s.errorAt(i, "after top-level value")
+				}
+				return nil
+			}
+			if i >= len(s.data) {
+				return s.unexpectedEnd()
+			}
+
+			closing := stack[len(stack)-1]
+			if s.data[i] == closing {
+				stack = stack[:len(stack)-1]
+				i++
+				continue
+			}
+			if s.data[i] != ',' {
+				if closing == '}' {
+					return s.errorAt(i, "after object key:value pair")
+				}
+				return s.errorAt(i, "after array element")
+			}
+
+			i = s.skipSpace(i + 1)
+			if closing == '}' {
+				if i, err = s.checkKey(i); err != nil {
+					return err
+				}
+			}
+			break
+		}
+	}
+}
+
+// checkKey validate object key starting at i and return offset of its value
+func (s *scanner) checkKey(i int) (int, error) {
+	if i >= len(s.data) {
+		return i, s.unexpectedEnd()
+	}
+	if s.data[i] != '"' {
+		return i, s.errorAt(i, "looking for beginning of object key string")
+	}
+
+	i, err := s.checkString(i)
+	if err != nil {
+		return i, err
+	}
+
+	i = s.skipSpace(i)
+	if i >= len(s.data) {
+		return i, s.unexpectedEnd()
+	}
+	if s.data[i] != ':' {
+		return i, s.errorAt(i, "after object key")
+	}
+
+	return s.skipSpace(i + 1), nil
+}
+
+// checkScalar validate string, number or literal starting at i and return offset right after it
+func (s *scanner) checkScalar(i int) (int, error) {
+	switch c := s.data[i]; {
+	case c == '"':
+		return s.checkString(i)
+	case c == '-' || isDigit(c):
+		return s.checkNumber(i)
+	case c == 't':
+		return s.checkLiteral(i, "true")
+	case c == 'f':
+		return s.checkLiteral(i, "false")
+	case c == 'n':
+		return s.checkLiteral(i, "null")
+	}
+
+	return i, s.errorAt(i, "looking for beginning of value")
+}
+
+func (s *scanner) checkString(i int) (int, error) {
+	for i++; i < len(s.data); i++ {
+		switch c := s.data[i]; {
+		case c == '"':
+			return i + 1, nil
+		case c < 0x20:
+			return i, s.errorAt(i, "in string literal")
+		case c == '\\':
+			i++
+			if i >= len(s.data) {
+				return i, s.unexpectedEnd()
+			}
+			switch s.data[i] {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+			case 'u':
+				for j := 0; j < 4; j++ {
+					i++
+					if i >= len(s.data) {
+						return i, s.unexpectedEnd()
+					}
+					if !isHex(s.data[i]) {
+						return i, s.errorAt(i, "in \\u hexadecimal character escape")
+					}
+				}
+			default:
+				return i, s.errorAt(i, "in string escape code")
+			}
+		}
+	}
+
+	return i, s.unexpectedEnd()
+}
+
+func (s *scanner) checkNumber(i int) (int, error) {
+	if s.data[i] == '-' {
+		i++
+	}
+	if i >= len(s.data) {
+		return i, s.unexpectedEnd()
+	}
+
+	switch {
+	case s.data[i] == '0':
+		i++
+	case s.data[i] >= '1' && s.data[i] <= '9':
+		i = s.skipDigits(i)
+	default:
+		return i, s.errorAt(i, "in numeric literal")
+	}
+
+	if i < len(s.data) && s.data[i] == '.' {
+		i++
+		if i >= len(s.data) {
+			return i, s.unexpectedEnd()
+		}
+		if !isDigit(s.data[i]) {
+			return i, s.errorAt(i, "after decimal point in numeric literal")
+		}
+		i = s.skipDigits(i)
+	}
+
+	if i < len(s.data) && (s.data[i] == 'e' || s.data[i] == 'E') {
+		i++
+		if i < len(s.data) && (s.data[i] == '+' || s.data[i] == '-') {
+			i++
+		}
+		if i >= len(s.data) {
+			return i, s.unexpectedEnd()
+		}
+		if !isDigit(s.data[i]) {
+			return i, s.errorAt(i, "in exponent of numeric literal")
+		}
+		i = s.skipDigits(i)
+	}
+
+	return i, nil
+}
+
+func (s *scanner) checkLiteral(i int, literal string) (int, error) {
+	for j := 0; j < len(literal); j++ {
+		if i+j >= len(s.data) {
+			return i + j, s.unexpectedEnd()
+		}
+		if s.data[i+j] != literal[j] {
+			return i + j, s.errorAt(i+j, fmt.Sprintf("in literal %s (expecting %q)", literal, literal[j]))
+		}
+	}
+
+	return i + len(literal), nil
+}
+
+func (s *scanner) skipDigits(i int) int {
+	for i < len(s.data) && isDigit(s.data[i]) {
+		i++
+	}
+	return i
+}
+
+// skipSpace return offset of the first byte from i that is not whitespace
+func (s *scanner) skipSpace(i int) int {
+	for i < len(s.data) {
+		switch s.data[i] {
+		case ' ', '\t', '\r', '\n':
+			i++
+		default:
+			return i
+		}
+	}
+
+	return i
+}
+
+// skipValue return offset right after value starting at i, data must be validated
+func (s *scanner) skipValue(i int) int {
+	switch s.data[i] {
+	case '"':
+		return s.skipString(i)
+	case '{', '[':
+		if s.containers != nil {
+			k := sort.Search(len(s.containers), func(k int) bool {
+				return s.containers[k].start >= i
+			})
+			if k < len(s.containers) && s.containers[k].start == i {
+				return s.containers[k].end
+			}
+		}
+
+		depth := 0
+		for i < len(s.data) {
+			switch s.data[i] {
+			case '"':
+				i = s.skipString(i)
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
+			}
+			i++
+		}
+		return i
+	}
+
+	for i < len(s.data) {
+		switch s.data[i] {
+		case ',', '}', ']', ' ', '\t', '\r', '\n':
+			return i
+		}
+		i++
+	}
+
+	return i
+}
+
+// skipString return offset right after string starting at i, data must be validated
+func (s *scanner) skipString(i int) int {
+	for i++; i < len(s.data); i++ {
+		switch s.data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+
+	return i
+}
+
+// index record span of every object and list of validated data in a single pass
+func (s *scanner) index() {
+	s.containers = make([]span, 0, 64)
+	var open []int // index in containers of every open container
+	for i := 0; i < len(s.data); i++ {
+		switch s.data[i] {
+		case '"':
+			i = s.skipString(i) - 1
+		case '{', '[':
+			open = append(open, len(s.containers))
+			s.containers = append(s.containers, span{start: i})
+		case '}', ']':
+			s.containers[open[len(open)-1]].end = i + 1
+			open = open[:len(open)-1]
+		}
+	}
+}
+
+// scanMembers append members of object starting at i and return offset right after it, data must be validated
+func (s *scanner) scanMembers(i int, members []member) ([]member, int) {
+	for i = s.skipSpace(i + 1); s.data[i] != '}'; {
+		var m member
+		m.key, m.keyEnd = i, s.skipString(i)
+		m.value = s.skipSpace(s.skipSpace(m.keyEnd) + 1)
+		m.valueEnd = s.skipValue(m.value)
+		members = append(members, m)
+
+		if i = s.skipSpace(m.valueEnd); s.data[i] == ',' {
+			i = s.skipSpace(i + 1)
+		}
+	}
+
+	return members, i + 1
+}
+
+// findMember return index of the last member named name, as the last duplicate key wins on decode, or -1
+func (s *scanner) findMember(members []member, name string) int {
+	for k := len(members) - 1; k >= 0; k-- {
+		if s.equal(members[k].key, members[k].keyEnd, name) {
+			return k
+		}
+	}
+
+	return -1
+}
+
+// unquote return content of string between start and end as decoded, invalid UTF-8 is replaced
+func (s *scanner) unquote(start, end int) string {
+	content := s.data[start+1 : end-1]
+	if bytes.IndexByte(content, '\\') < 0 && utf8.Valid(content) {
+		return string(content)
+	}
+
+	var value string
+	_ = json.Unmarshal(s.data[start:end], &value)
+	return value
+}
+
+// equal check whether string between start and end hold value
+func (s *scanner) equal(start, end int, value string) bool {
+	content := s.data[start+1 : end-1]
+	if string(content) == value {
+		return true
+	}
+
+	return (bytes.IndexByte(content, '\\') >= 0 || !utf8.Valid(content)) && s.unquote(start, end) == value
+}
+
+func (s *scanner) errorAt(i int, context string) error {
+	return newSyntaxError(fmt.Sprintf("invalid character %q %s", s.data[i], context), s.data, i)
+}
+
+func (s *scanner) unexpectedEnd() error {
+	return newSyntaxError("unexpected end of JSON input", s.data, len(s.data))
+}
+
+// appendCompact append src to dst without whitespace outside of strings, src must not split a string
+func appendCompact(dst, src []byte) []byte {
+	inString := false
+	start := 0
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		if inString {
+			switch c {
+			case '\\':
+				i++
+			case '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString = true
+		case ' ', '\t', '\r', '\n':
+			dst = append(dst, src[start:i]...)
+			start = i + 1
+		}
+	}
+
+	return append(dst, src[start:]...)
+}
+
+// compactLen return length of src without whitespace outside of strings, src must not split a string
+func compactLen(src []byte) int {
+	n := len(src)
+	inString := false
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		if inString {
+			switch c {
+			case '\\':
+				i++
+			case '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString = true
+		case ' ', '\t', '\r', '\n':
+			n--
+		}
+	}
+
+	return n
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+type (
+	// scanDeflater deflate document by scanning its bytes, without decoding it into a tree.
+	// Output is copied from the document range by range, compacted unless verbatim output is set.
+	scanDeflater struct {
+		*deflateState
+		scanner
+		out []byte
+		// path lead to the current object
+		path    *pathNode
+		members []member
+		ids     []int
+		key     []byte
+		scratch fingerprint
+		// firsts hold start of the first occurrence of every memoized entity whose fingerprint is not taken yet
+		firsts map[string]int
+		hashes map[int]hashed
+		// saved count bytes saved by stubs, whitespace removed by compact output excluded
+		saved int
+		// needEntity is set when rules, hooks or conflict policy need Entity of every candidate
+		needEntity bool
+	}
+)
+
+func newScanDeflater(c *config, data []byte) *scanDeflater {
+	return &scanDeflater{
+		deflateState: &deflateState{
+			config:  c,
+			memoize: make(map[string]fingerprint),
+		},
+		scanner:    scanner{data: data},
+		path:       newPath(),
+		out:        make([]byte, 0, len(data)),
+		scratch:    make(fingerprint),
+		firsts:     make(map[string]int),
+		needEntity: len(c.rules) > 0 || len(c.hooks) > 0 || c.conflictPolicy != ConflictIgnore,
+	}
+}
+
+// run deflate the whole document, data must be validated
+func (s *scanDeflater) run() error {
+	s.index()
+	start := s.skipSpace(0)
+	s.copy(0, start)
+	end, err := s.walk(start)
+	if err != nil {
+		return err
+	}
+	s.copy(end, len(s.data))
+
+	return nil
+}
+
+// copy append document range to output
+func (s *scanDeflater) copy(start, end int) {
+	s.out = appendRange(s.out, s.data[start:end], s.config.verbatim)
+}
+
+func (s *scanDeflater) walk(i int) (int, error) {
+	switch s.data[i] {
+	case '{':
+		return s.object(i)
+	case '[':
+		return s.array(i)
+	}
+
+	end := s.skipValue(i)
+	s.copy(i, end)
+	return end, nil
+}
+
+func (s *scanDeflater) array(i int) (int, error) {
+	pos := i
+	for i++; ; {
+		i = s.skipSpace(i)
+		switch s.data[i] {
+		case ']':
+			s.copy(pos, i+1)
+			return i + 1, nil
+		case ',':
+			i++
+			continue
+		}
+
+		s.copy(pos, i)
+		end, err := s.walk(i)
+		if err != nil {
+			return end, err
+		}
+		pos, i = end, end
+	}
+}
+
+func (s *scanDeflater) object(i int) (int, error) {
+	base := len(s.members)
+	var end int
+	s.members, end = s.scanMembers(i, s.members)
+	defer func() {
+		s.members = s.members[:base]
+	}()
+
+	deflated, err := s.visit(base, i, end)
+	if err != nil || deflated {
+		return end, err
+	}
+
+	pos := i
+	for k := base; k < len(s.members); k++ {
+		m := s.members[k]
+		switch s.data[m.value] {
+		case '{', '[':
+			s.copy(pos, m.value)
+			parent := s.path
+			s.path = parent.child(s.unquote(m.key, m.keyEnd))
+
+			_, err := s.walk(m.value)
+
+			s.path = parent
+			if err != nil {
+				return end, err
+			}
+			pos = m.valueEnd
+		}
+	}
+	s.copy(pos, end)
+
+	return end, nil
+}
+
+// find return index of the last member named name from base, or -1
+func (s *scanDeflater) find(base int, name string) int {
+	if k := s.findMember(s.members[base:], name); k >= 0 {
+		return base + k
+	}
+	return -1
+}
+
+// present report whether member k exists and is not null
+func (s *scanDeflater) present(k int) bool {
+	return k >= 0 && s.data[s.members[k].value] != 'n'
+}
+
+// visit memoize entity of object between start and end whose members are pushed from base,
+// or write its stub when it is deflatable
+func (s *scanDeflater) visit(base, start, end int) (bool, error) {
+	typename := s.find(base, s.config.typenameField)
+	if typename < 0 || s.data[s.members[typename].value] != '"' {
+		return false, nil
+	}
+
+	tm := s.members[typename]
+	name := s.unquote(tm.value, tm.valueEnd)
+	s.ids = s.ids[:0]
+	fields, composite := s.config.typeIdentifiers[name]
+	if composite {
+		for _, field := range fields {
+			k := s.find(base, field)
+			if !s.present(k) {
+				return false, nil
+			}
+			s.ids = append(s.ids, k)
+		}
+	} else {
+		for _, field := range s.config.identifiers {
+			if k := s.find(base, field); s.present(k) {
+				s.ids = append(s.ids, k)
+				fields = []string{field}
+				break
+			}
+		}
+	}
+	if len(s.ids) == 0 {
+		return false, nil
+	}
+
+	var entity Entity
+	if s.needEntity {
+		var ok bool
+		if entity, ok = s.entity(tm, fields); !ok {
+			return false, nil
+		}
+	}
+
+	s.key = s.key[:0]
+	if !s.config.isGlobal(name) {
+		s.key = strconv.AppendInt(s.key, int64(s.path.id), 10)
+	}
+	s.key = appendKeyString(append(s.key, '#'), name)
+	for i, k := range s.ids {
+		s.key = appendKeyString(s.key, fields[i])
+		s.key = s.appendKeyValue(s.key, s.members[k].value, s.members[k].valueEnd)
+	}
+
+	memoized, found := s.memoize[string(s.key)]
+	if !found {
+		// fingerprint is only taken once a duplicate turns up, most entities have none
+		key := string(s.key)
+		s.firsts[key] = start
+		return false, s.memoizeEntity(name, key, nil, s.path)
+	}
+	if memoized == nil {
+		memoized = s.objectFingerprint(s.firsts[string(s.key)])
+		s.memoize[string(s.key)] = memoized
+	}
+
+	for k := range s.scratch {
+		delete(s.scratch, k)
+	}
+	var names []string
+	if s.config.conflictPolicy != ConflictIgnore {
+		names = make([]string, 0, len(s.members)-base)
+		for _, m := range s.members[base:] {
+			names = append(names, s.unquote(m.key, m.keyEnd))
+		}
+	}
+
+	deflatable, err := s.deflatable(entity, s.path, memoized, s.fingerprint(base, s.scratch), names)
+	if err != nil || !deflatable {
+		return false, err
+	}
+	s.countStub(name, s.path)
+
+	stubStart := len(s.out)
+	s.out = append(s.out, '{')
+	s.out = append(s.out, s.data[tm.key:tm.keyEnd]...)
+	s.out = append(append(s.out, ':'), s.data[tm.value:tm.valueEnd]...)
+	for _, k := range s.ids {
+		m := s.members[k]
+		s.out = append(append(s.out, ','), s.data[m.key:m.keyEnd]...)
+		s.out = appendCompact(append(s.out, ':'), s.data[m.value:m.valueEnd])
+	}
+	if s.config.format == FormatMarked {
+		s.out = append(s.out, `,"`+Marker+`":true`...)
+	}
+	s.out = append(s.out, '}')
+
+	if s.config.verbatim {
+		s.saved += end - start - (len(s.out) - stubStart)
+	} else {
+		s.saved += compactLen(s.data[start:end]) - (len(s.out) - stubStart)
+	}
+
+	return true, nil
+}
+
+// entity build Entity of object, ok is false when it is excluded by rules
+func (s *scanDeflater) entity(typename member, fields []string) (entity Entity, ok bool) {
+	entity = Entity{
+		Typename:    s.unquote(typename.value, typename.valueEnd),
+		Identifiers: fields,
+		ID:          make([]interface{}, len(s.ids)),
+	}
+	for i, k := range s.ids {
+		m := s.members[k]
+		id, err := decode(s.data[m.value:m.valueEnd])
+		if err != nil {
+			return Entity{}, false
+		}
+		entity.ID[i] = id
+	}
+	if len(s.config.rules) > 0 {
+		entity.Path = s.path.fields()
+	}
+	for _, rule := range s.config.rules {
+		if !rule(entity) {
+			return Entity{}, false
+		}
+	}
+
+	return entity, true
+}
+
+// appendKeyString append s to memoize key prefixed by its length, so that keys never run into each other
+func appendKeyString(key []byte, s string) []byte {
+	key = strconv.AppendInt(key, int64(len(s)), 10)
+	return append(append(key, ':'), s...)
+}
+
+// appendKeyValue append identifier value between start and end to memoize key as decoded, so that escaped
+// and unescaped strings share a key as they do on inflate. Numbers keep their literal as json.Number does.
+func (s *scanDeflater) appendKeyValue(key []byte, start, end int) []byte {
+	switch s.data[start] {
+	case '"':
+		return appendKeyString(append(key, 's'), s.unquote(start, end))
+	case '{', '[':
+		value, _ := decode(s.data[start:end])
+		encoded, _ := json.Marshal(value)
+		return appendKeyString(append(key, 'j'), string(encoded))
+	}
+
+	return append(append(append(key, 'n'), s.data[start:end]...), ',')
+}
+
+// fingerprint fill f with fields of object whose members are pushed from base
+func (s *scanDeflater) fingerprint(base int, f fingerprint) fingerprint {
+	for _, m := range s.members[base:] {
+		f[s.nameHash(m.key, m.keyEnd)], _ = s.hash(m.value)
+	}
+
+	return f
+}
+
+// objectFingerprint return fingerprint of object starting at i
+func (s *scanDeflater) objectFingerprint(i int) fingerprint {
+	f := make(fingerprint)
+	for i = s.skipSpace(i + 1); s.data[i] != '}'; {
+		keyEnd := s.skipString(i)
+		value, end := s.hash(s.skipSpace(s.skipSpace(keyEnd) + 1))
+		f[s.nameHash(i, keyEnd)] = value
+
+		if i = s.skipSpace(end); s.data[i] == ',' {
+			i = s.skipSpace(i + 1)
+		}
+	}
+
+	return f
+}
+
+// nameHash hash name of key between start and end the same way as nameHash
+func (s *scanner) nameHash(start, end int) uint64 {
+	content := s.data[start+1 : end-1]
+	if bytes.IndexByte(content, '\\') >= 0 || !utf8.Valid(content) {
+		return nameHash(s.unquote(start, end))
+	}
+
+	return hashBytes(offset64, content)
+}
+
+// hash hash value starting at i the same way as hashOf, except that string values are hashed as escaped in document,
+// and return its end. Objects and lists are hashed once, their hash is cached for enclosing and duplicate entities.
+func (s *scanDeflater) hash(i int) (valueHash, int) {
+	switch s.data[i] {
+	case '{', '[':
+		if h, ok := s.hashes[i]; ok {
+			return h.hash, h.end
+		}
+	}
+
+	start := i
+	var hash valueHash
+	switch s.data[i] {
+	case '{':
+		hasher := newObjectHasher()
+		for i = s.skipSpace(i + 1); s.data[i] != '}'; {
+			keyEnd := s.skipString(i)
+			value, end := s.hash(s.skipSpace(s.skipSpace(keyEnd) + 1))
+			hasher.add(s.nameHash(i, keyEnd), value)
+
+			if i = s.skipSpace(end); s.data[i] == ',' {
+				i = s.skipSpace(i + 1)
+			}
+		}
+		hash, i = hasher.sum(), i+1
+	case '[':
+		hasher := newArrayHasher()
+		for i = s.skipSpace(i + 1); s.data[i] != ']'; {
+			value, end := s.hash(i)
+			hasher.add(value)
+
+			if i = s.skipSpace(end); s.data[i] == ',' {
+				i = s.skipSpace(i + 1)
+			}
+		}
+		hash, i = hasher.sum(), i+1
+	default:
+		end := s.skipValue(i)
+		var value uint64
+		switch s.data[i] {
+		case '"':
+			value = hashBytes(hashString(offset64, "s"), s.data[i+1:end-1])
+		case 't', 'f', 'n':
+			value = hashBytes(offset64, s.data[i:end])
+		default:
+			value = hashBytes(hashString(offset64, "n"), s.data[i:end])
+		}
+		return valueHash{shape: scalarShape, value: value}, end
+	}
+
+	if s.hashes == nil {
+		s.hashes = make(map[int]hashed)
+	}
+	s.hashes[start] = hashed{hash: hash, end: i}
+	return hash, i
+}
@@ -0,0 +1,261 @@
+package gqldeduplicator
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScannerValidate(t *testing.T) {
+	t.Run("should accept valid json", func(t *testing.T) {
+		for _, given := range []string{
+			`{}`, ` [ ] `, `"a\"\\\/\b\f\n\r\té"`, `-0.5e+10`, `0`, `true`, `false`, `null`,
+			`{"a":[1,{"b":null}],"c":{"d":"e"}}`, "{\n\t\"a\" : [ 1 , 2 ]\r\n}",
+		} {
+			s := scanner{data: []byte(given)}
+			assert.NoError(t, s.validate(0), given)
+		}
+	})
+
+	tests := []struct {
+		Name     string
+		Given    string
+		Expected string
+	}{
+		{
+			Name:     "empty input",
+			Given:    ``,
+			Expected: "unexpected end of JSON input at offset 0",
+		},
+		{
+			Name:     "unterminated object",
+			Given:    `{"a":1`,
+			Expected: "unexpected end of JSON input at offset 6",
+		},
+		{
+			Name:     "missing colon",
+			Given:    `{"a" 1}`,
+			Expected: `invalid character '1' after object key at offset 5`,
+		},
+		{
+			Name:     "trailing comma",
+			Given:    `[1,]`,
+			Expected: `invalid character ']' looking for beginning of value at offset 3`,
+		},
+		{
+			Name:     "unquoted key",
+			Given:    `{a:1}`,
+			Expected: `invalid character 'a' looking for beginning of object key string at offset 1`,
+		},
+		{
+			Name:     "leading zero",
+			Given:    `[01]`,
+			Expected: `invalid character '1' after array element at offset 2`,
+		},
+		{
+			Name:     "invalid escape",
+			Given:    `"\x"`,
+			Expected: `invalid character 'x' in string escape code at offset 2`,
+		},
+		{
+			Name:     "invalid literal",
+			Given:    `{"a":tru}`,
+			Expected: `invalid character '}' in literal true (expecting 'e') at offset 8`,
+		},
+		{
+			Name:     "trailing data",
+			Given:    `{} {}`,
+			Expected: `invalid character '{' after top-level value at offset 3`,
+		},
+	}
+	for _, test := range tests {
+		t.Run("should reject "+test.Name, func(t *testing.T) {
+			s := scanner{data: []byte(test.Given)}
+			assert.EqualError(t, s.validate(0), test.Expected)
+		})
+	}
+}
+
+func TestAppendCompact(t *testing.T) {
+	result := appendCompact([]byte("x"), []byte("{ \"a b\" : [ 1,\n\t\"c\\\" d\" ] }"))
+	assert.Equal(t, `x{"a b":[1,"c\" d"]}`, string(result))
+}
+
+// TestDeflateEngine check that scanning engine deflate the same way as the tree walker
+func TestDeflateEngine(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Given   string
+		Options []Option
+	}{
+		{
+			Name:  "whitespace and nested lists",
+			Given: "{ \"a\" : [ [ {\"__typename\":\"foo\", \"id\":1, \"b\":{ \"x\" : [1, 2] }} ], {\"__typename\":\"foo\",\"id\":1,\"b\":{\"x\":[3,4]}} ] }",
+		},
+		{
+			Name:  "escaped keys and values",
+			Given: `{"a":[{"__typename":"f\"o","id":"11","v":"<"},{"__typename":"f\"o","id":"11","v":"<"}]}`,
+		},
+		{
+			Name:  "escaped and unescaped names and identifiers",
+			Given: `{"a":[{"__typename":"foo","id":"ab","v":1},{"__typename":"f\u006fo","i\u0064":"a\u0062","v":1},{"b":{"__typename":"foo","id":"ab","v":1}},{"\u0062":{"__typename":"foo","id":"ab","v":1}}]}`,
+		},
+		{
+			Name:  "duplicate keys",
+			Given: `{"a":[{"__typename":"foo","id":1,"id":2,"v":1},{"__typename":"foo","id":2,"v":1},{"__typename":"foo","id":1,"v":1}]}`,
+		},
+		{
+			Name:  "null identifier and non string typename",
+			Given: `{"a":[{"__typename":"foo","id":null},{"__typename":"foo","id":null},{"__typename":1,"id":1},{"__typename":1,"id":1}]}`,
+		},
+		{
+			Name:  "different selection",
+			Given: `{"a":[{"__typename":"foo","id":1,"b":{"c":1}},{"__typename":"foo","id":1,"b":{"d":1}},{"__typename":"foo","id":1,"b":{"c":2}}]}`,
+		},
+		{
+			Name:    "composite and fallback identifiers",
+			Given:   `{"a":[{"__typename":"foo","x":1,"y":{"z":1}},{"__typename":"foo","x":1,"y":{ "z" : 1 }},{"__typename":"bar","uuid":"u"},{"__typename":"bar","uuid":"u"}]}`,
+			Options: []Option{WithTypeIdentifier("foo", "x", "y"), WithIdentifier("id", "uuid")},
+		},
+		{
+			Name:    "rules and conflicts",
+			Given:   `{"a":[{"__typename":"foo","id":1,"v":1},{"__typename":"foo","id":1,"v":2},{"__typename":"bar","id":1},{"__typename":"bar","id":1}]}`,
+			Options: []Option{WithConflictPolicy(ConflictKeepBoth), WithRule(func(entity Entity) bool { return entity.Typename != "bar" })},
+		},
+	}
+	for _, test := range tests {
+		t.Run("should match tree walker on "+test.Name, func(t *testing.T) {
+			deflater := NewDeflater(test.Options...)
+			expected, err := deflateTree(deflater, []byte(test.Given))
+			assert.NoError(t, err)
+
+			result, err := deflater.Deflate([]byte(test.Given))
+			assert.NoError(t, err)
+			assert.JSONEq(t, string(expected), string(result.Data))
+		})
+	}
+
+	t.Run("should share key between escaped and unescaped names and identifiers", func(t *testing.T) {
+		given := `[{"x":{"__typename":"foo","id":"ab","v":1}},{"x":{"__typename":"f\u006fo","i\u0064":"a\u0062","v":1}},{"\u0078":{"__typename":"foo","id":"\u0061b","v":1}}]`
+		result, err := Deflate([]byte(given))
+		assert.NoError(t, err)
+		assert.Equal(t, 2, result.Stats.Stubs)
+		assert.Equal(t, map[string]int{"x": 2}, result.Stats.ByPath)
+
+		inflated, err := Inflate(result.Data)
+		assert.NoError(t, err)
+		assert.JSONEq(t, given, string(inflated.Data))
+	})
+
+	t.Run("should keep input as is on verbatim output", func(t *testing.T) {
+		given := "{ \"a\" : [ {\"__typename\":\"foo\", \"id\" : 1, \"v\":\"<\"},\n {\"__typename\":\"foo\", \"id\" : 1, \"v\":\"<\"} ] }\n"
+		result, err := NewDeflater(WithVerbatimOutput()).Deflate([]byte(given))
+		assert.NoError(t, err)
+		assert.Equal(t, "{ \"a\" : [ {\"__typename\":\"foo\", \"id\" : 1, \"v\":\"<\"},\n {\"__typename\":\"foo\",\"id\":1} ] }\n", string(result.Data))
+	})
+}
+
+// deflateTree deflate data by decoding it into a tree, as Deflate did before the scanning engine
+func deflateTree(d *Deflater, data []byte) ([]byte, error) {
+	node, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &deflateState{
+		config:  &d.config,
+		memoize: make(map[string]fingerprint),
+		hashes:  make(hashCache),
+	}
+	node, err = state.deflate(node, newPath())
+	if err != nil {
+		return nil, err
+	}
+
+	return encode(data, node, state.edits, d.config.verbatim, 0)
+}
+
+// benchmarkResponse generate graphql response of stories, each written by one of few authors with their followers
+func benchmarkResponse(stories int) []byte {
+	var b strings.Builder
+	b.WriteString(`{"data":{"stories":[`)
+	for i := 0; i < stories; i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		author := i % 10
+		fmt.Fprintf(&b, `{"__typename":"Story","id":%d,"title":"Story number %d","body":"Lorem ipsum dolor sit amet, consectetur adipiscing elit.",`, i, i)
+		fmt.Fprintf(&b, `"author":{"__typename":"User","id":%d,"name":"User %d","avatar":"https://example.com/avatar/%d.png",`, author, author, author)
+		b.WriteString(`"followers":[`)
+		for j := 0; j < 5; j++ {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			follower := (author + j) % 20
+			fmt.Fprintf(&b, `{"__typename":"User","id":%d,"name":"User %d"}`, follower, follower)
+		}
+		b.WriteString(`]}}`)
+	}
+	b.WriteString(`]}}`)
+
+	return []byte(b.String())
+}
+
+func BenchmarkDeflate(b *testing.B) {
+	data := benchmarkResponse(1000)
+	deflater := NewDeflater()
+
+	b.Run("scan", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			if _, err := deflater.Deflate(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("tree", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			if _, err := deflateTree(deflater, data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// nestedResponse return depth objects nested in each other, each one an entity when entities is set
+func nestedResponse(depth int, entities bool) []byte {
+	open := `{"a":`
+	if entities {
+		open = `{"__typename":"U","id":1,"a":`
+	}
+
+	return []byte(strings.Repeat(open, depth) + "null" + strings.Repeat("}", depth))
+}
+
+func BenchmarkDeflateNested(b *testing.B) {
+	for _, test := range []struct {
+		Name     string
+		Depth    int
+		Entities bool
+	}{
+		{Name: "entities", Depth: 1000, Entities: true},
+		{Name: "objects", Depth: 5000},
+	} {
+		data := nestedResponse(test.Depth, test.Entities)
+		b.Run(test.Name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := Deflate(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
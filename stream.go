@@ -0,0 +1,721 @@
+package gqldeduplicator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+var errUnorderedEntity = errors.New("entity of global typename is identified after its nested duplicate is deflated, " +
+	"it cannot be streamed in document order")
+
+type (
+	// streamWriter write buffered output and copy it to capture buffer while any capture is open,
+	// size measure output against output size limit
+	streamWriter struct {
+		*bufio.Writer
+		size      limitWriter
+		capture   bytes.Buffer
+		capturing int
+	}
+
+	// countingWriter count bytes written to the underlying writer
+	countingWriter struct {
+		io.Writer
+		n int
+	}
+
+	// limitReader read from the underlying reader and fail with *LimitError once more than max bytes are read
+	limitReader struct {
+		io.Reader
+		n, max int
+	}
+
+	// depthReader read from the underlying reader and fail with *LimitError before it return
+	// opening brace or bracket nested more than max deep, strings are skipped
+	depthReader struct {
+		io.Reader
+		depth, max       int
+		inString, escape bool
+	}
+
+	deflateStream struct {
+		*deflateState
+		dec *json.Decoder
+		w   *streamWriter
+		// depth is the number of containers the current value is nested in
+		depth int
+	}
+
+	inflateStream struct {
+		config   *config
+		dec      *json.Decoder
+		w        *streamWriter
+		entities map[string][]byte
+		inflated bool
+		// unresolved hold stubs reported under UnresolvedReport policy
+		unresolved []Entity
+		// depth is the number of containers the current value is nested in
+		depth int
+	}
+)
+
+// DeflateStream deflate graphql response read from r and write it to w by id as default identifier.
+// See Deflater.DeflateStream.
+func DeflateStream(r io.Reader, w io.Writer) (*DeflateResult, error) {
+	return defaultDeflater.DeflateStream(r, w)
+}
+
+// InflateStream inflate graphql response read from r and write it to w by id as default identifier.
+// See Inflater.InflateStream.
+func InflateStream(r io.Reader, w io.Writer) (*InflateResult, error) {
+	return defaultInflater.InflateStream(r, w)
+}
+
+// DeflateStream deflate graphql response read from r and write it as compact JSON to w, result Data is always nil.
+// Objects are streamed through as they are read, except object at a path where an entity is memoized,
+// or object whose typename and identifier, read before any nested list or object, are those of a memoized entity,
+// which is read in full to be compared with the memoized one. Entity of global typename identified only after
+// a nested list or object is never replaced by a stub, and stream fail when a duplicate of it nested inside it
+// is already replaced by a stub, as that stub would refer to it on inflate. Only memoized fingerprints are kept in memory.
+// WithVerbatimOutput has no effect on stream.
+func (d *Deflater) DeflateStream(r io.Reader, w io.Writer) (*DeflateResult, error) {
+	config := d.config
+	config.verbatim = false
+	counter := &countingWriter{Writer: w}
+	s := &deflateStream{
+		deflateState: &deflateState{
+			config:  &config,
+			memoize: make(map[string]fingerprint),
+			hashes:  make(hashCache),
+			paths:   make(map[int]bool),
+		},
+		dec: newStreamDecoder(r, &config),
+		w:   &streamWriter{Writer: bufio.NewWriter(counter)},
+	}
+	if config.hasGlobal() {
+		s.order, s.stubbed = make(map[string]int), make(map[string]bool)
+	}
+
+	if _, _, err := s.value(newPath()); err != nil {
+		return nil, decoderError(err, s.dec)
+	}
+	if err := endStream(s.dec); err != nil {
+		return nil, decoderError(err, s.dec)
+	}
+	if err := s.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	s.stats.InputSize, s.stats.OutputSize = int(s.dec.InputOffset()), counter.n
+	return &DeflateResult{
+		Deflated:  s.deflated,
+		Conflicts: s.conflicts,
+		Stats:     s.stats,
+	}, nil
+}
+
+// InflateStream inflate graphql response read from r and write it as compact JSON to w, result Data is always nil.
+// Unlike Inflate it works in a single pass, a stub is only inflated when its full object is read before it,
+// which is always the case for output of Deflate and DeflateStream, otherwise it is unresolved.
+// Only output of full objects inside lists is kept in memory, since only those may be referred by later stubs,
+// or of full objects of global typename read before any nested list or object.
+// WithVerbatimOutput has no effect on stream.
+func (i *Inflater) InflateStream(r io.Reader, w io.Writer) (*InflateResult, error) {
+	s := &inflateStream{
+		config:   &i.config,
+		dec:      newStreamDecoder(r, &i.config),
+		w:        &streamWriter{Writer: bufio.NewWriter(w), size: limitWriter{max: i.config.maxOutputSize}},
+		entities: make(map[string][]byte),
+	}
+
+	if err := s.value(newPath(), false); err != nil {
+		return nil, decoderError(err, s.dec)
+	}
+	if err := endStream(s.dec); err != nil {
+		return nil, decoderError(err, s.dec)
+	}
+	// errors of single delimiter writes are not checked as they go, output size is checked once more as a whole
+	if err := s.w.size.grow(0); err != nil {
+		return nil, err
+	}
+	if err := s.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	return &InflateResult{
+		Inflated:   s.inflated,
+		Unresolved: s.unresolved,
+	}, nil
+}
+
+func newStreamDecoder(r io.Reader, c *config) *json.Decoder {
+	if c.maxInputSize > 0 {
+		r = &limitReader{Reader: r, max: c.maxInputSize}
+	}
+
+	// json.Decoder fails on its own past defaultMaxDepth, so nesting is limited as it is read
+	dec := json.NewDecoder(&depthReader{Reader: r, max: decoderDepth(c.maxDepth)})
+	dec.UseNumber()
+	return dec
+}
+
+// Read read from the underlying reader, failing once more than max bytes are read
+func (l *limitReader) Read(p []byte) (int, error) {
+	n, err := l.Reader.Read(p)
+	if l.n += n; l.n > l.max {
+		return n, &LimitError{Limit: LimitInputSize, Max: l.max}
+	}
+	return n, err
+}
+
+// Read read from the underlying reader, failing before the first byte nested more than max deep and on every read after
+func (d *depthReader) Read(p []byte) (int, error) {
+	if d.depth > d.max {
+		return 0, &LimitError{Limit: LimitDepth, Max: d.max}
+	}
+
+	n, err := d.Reader.Read(p)
+	for i, c := range p[:n] {
+		switch {
+		case d.escape:
+			d.escape = false
+		case d.inString:
+			d.escape, d.inString = c == '\\', c != '"'
+		case c == '"':
+			d.inString = true
+		case c == '{' || c == '[':
+			if d.depth++; d.depth > d.max {
+				return i, &LimitError{Limit: LimitDepth, Max: d.max}
+			}
+		case c == '}' || c == ']':
+			d.depth--
+		}
+	}
+	return n, err
+}
+
+// Write write data to the underlying writer and count it
+func (c *countingWriter) Write(data []byte) (int, error) {
+	n, err := c.Writer.Write(data)
+	c.n += n
+	return n, err
+}
+
+// endStream make sure nothing but whitespace follow the top-level value
+func endStream(dec *json.Decoder) error {
+	if _, err := dec.Token(); err != io.EOF {
+		if err != nil {
+			return err
+		}
+		return &SyntaxError{Msg: "invalid data after top-level value", Offset: int(dec.InputOffset())}
+	}
+
+	return nil
+}
+
+// value stream next value and return hash of it as read
+func (s *deflateStream) value(path *pathNode) (interface{}, valueHash, error) {
+	token, err := nextToken(s.dec)
+	if err != nil {
+		return nil, valueHash{}, err
+	}
+
+	switch token {
+	case json.Delim('{'), json.Delim('['):
+		hash, err := s.container(token, path)
+		return nil, hash, err
+	}
+
+	return token, hashOf(token), writeValue(s.w, token, true)
+}
+
+// container stream object or list whose opening delimiter is already read
+func (s *deflateStream) container(delim json.Token, path *pathNode) (valueHash, error) {
+	s.depth++
+	if err := checkNesting(s.depth, s.config.maxDepth); err != nil {
+		return valueHash{}, err
+	}
+
+	var hash valueHash
+	var err error
+	if delim == json.Delim('{') {
+		hash, err = s.object(path)
+	} else {
+		hash, err = s.array(path)
+	}
+	s.depth--
+
+	return hash, err
+}
+
+func (s *deflateStream) array(path *pathNode) (valueHash, error) {
+	hasher := newArrayHasher()
+	s.w.WriteByte('[')
+	for i := 0; s.dec.More(); i++ {
+		if i > 0 {
+			s.w.WriteByte(',')
+		}
+
+		_, hash, err := s.value(path)
+		if err != nil {
+			return valueHash{}, err
+		}
+		hasher.add(hash)
+	}
+	if _, err := nextToken(s.dec); err != nil {
+		return valueHash{}, err
+	}
+	s.w.WriteByte(']')
+
+	return hasher.sum(), nil
+}
+
+// object stream object. Scalar members are held back until a nested list or object is read,
+// and object is only read in full when its typename and identifier among them turn out to be memoized,
+// or when it is at a path where an entity is memoized, so that it can be compared with the memoized one.
+func (s *deflateStream) object(path *pathNode) (valueHash, error) {
+	if s.paths[path.id] {
+		value, err := decodeObject(s.dec, nil, 0, s.depth+1, s.config.maxDepth)
+		if err != nil {
+			return valueHash{}, err
+		}
+		return s.full(value, path)
+	}
+
+	// object is streamed and memoized once its typename and identifier are known, before its nested objects
+	// so that entities are memoized in document order as Deflate does. Its fields are only known once it ends,
+	// until then it is memoized without fingerprint, which no nested duplicate match.
+	// Scalar members are kept to identify it, nested lists and objects are kept as null.
+	shadow := newObject()
+	fields := make(fingerprint)
+	hasher := newObjectHasher()
+	held := true
+	memoized, start := "", 0
+	for s.dec.More() {
+		token, err := nextToken(s.dec)
+		if err != nil {
+			return valueHash{}, err
+		}
+		key := token.(string)
+
+		if held {
+			member, err := nextToken(s.dec)
+			if err != nil {
+				return valueHash{}, err
+			}
+			if member != json.Delim('{') && member != json.Delim('[') {
+				shadow.set(key, member)
+				fields[nameHash(key)] = hashOf(member)
+				hasher.add(nameHash(key), hashOf(member))
+				continue
+			}
+
+			entity, entityKey, duplicate, err := s.identify(shadow, path)
+			if err != nil {
+				return valueHash{}, err
+			}
+			if duplicate {
+				return s.rest(shadow, key, member, path)
+			}
+			if entityKey != "" {
+				if err := s.memoizeEntity(entity.Typename, entityKey, nil, path); err != nil {
+					return valueHash{}, err
+				}
+				memoized = entityKey
+			}
+			start = len(s.memoize)
+
+			if err := s.writeHeld(shadow); err != nil {
+				return valueHash{}, err
+			}
+			held = false
+			if err := s.writeKey(key, len(shadow.keys) > 0); err != nil {
+				return valueHash{}, err
+			}
+			hash, err := s.container(member, path.child(key))
+			if err != nil {
+				return valueHash{}, err
+			}
+			shadow.set(key, nil)
+			fields[nameHash(key)] = hash
+			hasher.add(nameHash(key), hash)
+			continue
+		}
+
+		if err := s.writeKey(key, true); err != nil {
+			return valueHash{}, err
+		}
+		member, hash, err := s.value(path.child(key))
+		if err != nil {
+			return valueHash{}, err
+		}
+		shadow.set(key, member)
+		fields[nameHash(key)] = hash
+		hasher.add(nameHash(key), hash)
+	}
+	if _, err := nextToken(s.dec); err != nil {
+		return valueHash{}, err
+	}
+
+	if !held {
+		s.w.WriteByte('}')
+	}
+	if memoized != "" {
+		s.memoize[memoized] = fields
+		return hasher.sum(), nil
+	}
+
+	entity, key, duplicate, err := s.identify(shadow, path)
+	switch {
+	case err != nil:
+		return valueHash{}, err
+	case held && duplicate:
+		return s.full(shadow, path)
+	case held:
+		if err := writeValue(s.w, shadow, true); err != nil {
+			return valueHash{}, err
+		}
+	case duplicate && s.order[key] > start:
+		// identified only after a nested list or object where the same global entity is memoized,
+		// it comes first in document order so later duplicates are compared with it
+		if s.stubbed[key] {
+			return valueHash{}, errUnorderedEntity
+		}
+		s.memoize[key] = fields
+		return hasher.sum(), nil
+	}
+	if key != "" && !duplicate {
+		if err := s.memoizeEntity(entity.Typename, key, fields, path); err != nil {
+			return valueHash{}, err
+		}
+	}
+
+	return hasher.sum(), nil
+}
+
+// identify return entity identified by held scalar members, its memoize key and whether it is already memoized.
+// Key is empty when members identify no entity.
+func (s *deflateStream) identify(shadow *object, path *pathNode) (Entity, string, bool, error) {
+	entity, ok := s.config.entity(shadow, path)
+	if !ok {
+		return Entity{}, "", false, nil
+	}
+	key, err := s.config.key(entity, path)
+	if err != nil {
+		return Entity{}, "", false, err
+	}
+
+	_, found := s.memoize[key]
+	return entity, key, found, nil
+}
+
+// rest read the rest of object whose held scalar members identify a memoized entity,
+// starting from member key whose opening delimiter is already read, then deflate it in full
+func (s *deflateStream) rest(value *object, key string, delim json.Token, path *pathNode) (valueHash, error) {
+	var member interface{}
+	var err error
+	if delim == json.Delim('{') {
+		member, err = decodeObject(s.dec, nil, 0, s.depth+1, s.config.maxDepth)
+	} else {
+		member, err = decodeList(s.dec, nil, s.depth+1, s.config.maxDepth)
+	}
+	if err != nil {
+		return valueHash{}, err
+	}
+	value.set(key, member)
+
+	for s.dec.More() {
+		token, err := nextToken(s.dec)
+		if err != nil {
+			return valueHash{}, err
+		}
+		member, err := decodeValue(s.dec, nil, s.depth, s.config.maxDepth)
+		if err != nil {
+			return valueHash{}, err
+		}
+		value.set(token.(string), member)
+	}
+	if _, err := nextToken(s.dec); err != nil {
+		return valueHash{}, err
+	}
+
+	return s.full(value, path)
+}
+
+// full deflate object read in full and write it
+func (s *deflateStream) full(value *object, path *pathNode) (valueHash, error) {
+	hash := s.hashes.hash(value)
+	node, err := s.deflate(value, path)
+	if err != nil {
+		return valueHash{}, err
+	}
+
+	return hash, writeValue(s.w, node, true)
+}
+
+// writeHeld write opening brace and members held so far
+func (s *deflateStream) writeHeld(shadow *object) error {
+	s.w.WriteByte('{')
+	for i, k := range shadow.keys {
+		if err := s.writeKey(k, i > 0); err != nil {
+			return err
+		}
+		if err := writeValue(s.w, shadow.values[k], true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeKey write member name followed by colon, preceded by comma unless it is the first member
+func (s *deflateStream) writeKey(key string, comma bool) error {
+	if comma {
+		s.w.WriteByte(',')
+	}
+	if err := writeValue(s.w, key, true); err != nil {
+		return err
+	}
+	return s.w.WriteByte(':')
+}
+
+// value stream next value, inList report whether any ancestor is a list
+func (s *inflateStream) value(path *pathNode, inList bool) error {
+	token, err := nextToken(s.dec)
+	if err != nil {
+		return err
+	}
+
+	switch token {
+	case json.Delim('{'), json.Delim('['):
+		return s.container(token, path, inList)
+	}
+
+	return writeValue(s.w, token, true)
+}
+
+// container stream object or list whose opening delimiter is already read
+func (s *inflateStream) container(delim json.Token, path *pathNode, inList bool) error {
+	s.depth++
+	if err := checkNesting(s.depth, s.config.maxDepth); err != nil {
+		return err
+	}
+
+	var err error
+	if delim == json.Delim('{') {
+		err = s.object(path, inList)
+	} else {
+		err = s.array(path)
+	}
+	s.depth--
+
+	return err
+}
+
+func (s *inflateStream) array(path *pathNode) error {
+	s.w.WriteByte('[')
+	for i := 0; s.dec.More(); i++ {
+		if i > 0 {
+			s.w.WriteByte(',')
+		}
+		if err := s.value(path, true); err != nil {
+			return err
+		}
+	}
+	if _, err := nextToken(s.dec); err != nil {
+		return err
+	}
+	s.w.WriteByte(']')
+
+	return nil
+}
+
+// object stream object. Scalar members are held back until a nested list or object is read,
+// so that an object made of scalars only can be replaced when it turns out to be a stub.
+// Output of object inside a list, or whose typename among held members is global, is captured,
+// to be memoized when it turns out to be a full entity.
+func (s *inflateStream) object(path *pathNode, inList bool) error {
+	shadow := newObject()
+	held := true
+	start := -1
+
+	for s.dec.More() {
+		token, err := nextToken(s.dec)
+		if err != nil {
+			return err
+		}
+		key := token.(string)
+
+		member, err := nextToken(s.dec)
+		if err != nil {
+			return err
+		}
+
+		switch member {
+		case json.Delim('{'), json.Delim('['):
+			if held {
+				start = s.beginCapture(shadow, inList)
+				if err := s.writeHeld(shadow); err != nil {
+					return err
+				}
+				held = false
+			}
+			if len(shadow.keys) > 0 {
+				s.w.WriteByte(',')
+			}
+			if err := writeValue(s.w, key, true); err != nil {
+				return err
+			}
+			s.w.WriteByte(':')
+
+			shadow.set(key, nil)
+			if err := s.container(member, path.child(key), inList); err != nil {
+				return err
+			}
+		default:
+			shadow.set(key, member)
+			if held {
+				continue
+			}
+
+			s.w.WriteByte(',')
+			if err := writeValue(s.w, key, true); err != nil {
+				return err
+			}
+			s.w.WriteByte(':')
+			if err := writeValue(s.w, member, true); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := nextToken(s.dec); err != nil {
+		return err
+	}
+
+	entity, ok := s.config.entity(shadow, path)
+	if held {
+		if ok && s.config.isStub(shadow, entity) {
+			key, err := s.config.key(entity, path)
+			if err != nil {
+				return err
+			}
+			if full, found := s.entities[key]; found {
+				s.inflated = true
+				s.config.notify(entity, path)
+				_, err := s.w.Write(full)
+				return err
+			}
+			if s.unresolved, err = unresolve(s.config, s.unresolved, entity, path); err != nil {
+				return err
+			}
+		}
+
+		start = s.beginCapture(shadow, inList)
+		if err := writeValue(s.w, shadow, true); err != nil {
+			return err
+		}
+	} else {
+		s.w.WriteByte('}')
+	}
+
+	captured := s.w.endCapture(start)
+	if ok && captured != nil && !s.config.isStub(shadow, entity) {
+		key, err := s.config.key(entity, path)
+		if err != nil {
+			return err
+		}
+		if _, found := s.entities[key]; !found {
+			if err := s.config.checkEntities(len(s.entities) + 1); err != nil {
+				return err
+			}
+			s.entities[key] = append([]byte(nil), captured...)
+		}
+	}
+
+	return nil
+}
+
+// beginCapture open capture of object output when object inside a list or of global typename may be a full entity,
+// it return capture start or -1 when output is not captured
+func (s *inflateStream) beginCapture(shadow *object, inList bool) int {
+	typename, _ := shadow.values[s.config.typenameField].(string)
+	if !inList && (typename == "" || !s.config.isGlobal(typename)) {
+		return -1
+	}
+
+	return s.w.beginCapture()
+}
+
+// writeHeld write opening brace and members held so far
+func (s *inflateStream) writeHeld(shadow *object) error {
+	s.w.WriteByte('{')
+	for i, k := range shadow.keys {
+		if i > 0 {
+			s.w.WriteByte(',')
+		}
+		if err := writeValue(s.w, k, true); err != nil {
+			return err
+		}
+		s.w.WriteByte(':')
+		if err := writeValue(s.w, shadow.values[k], true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// beginCapture open capture and return its start offset
+func (w *streamWriter) beginCapture() int {
+	w.capturing++
+	return w.capture.Len()
+}
+
+// endCapture close capture opened at start and return its output, which is only valid until the next write.
+// It return nil when start is negative.
+func (w *streamWriter) endCapture(start int) []byte {
+	if start < 0 {
+		return nil
+	}
+
+	captured := w.capture.Bytes()[start:]
+	w.capturing--
+	if w.capturing == 0 {
+		w.capture.Reset()
+	}
+
+	return captured
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if _, err := w.size.Write(p); err != nil {
+		return 0, err
+	}
+	if w.capturing > 0 {
+		w.capture.Write(p)
+	}
+	return w.Writer.Write(p)
+}
+
+func (w *streamWriter) WriteByte(c byte) error {
+	if err := w.size.WriteByte(c); err != nil {
+		return err
+	}
+	if w.capturing > 0 {
+		w.capture.WriteByte(c)
+	}
+	return w.Writer.WriteByte(c)
+}
+
+func (w *streamWriter) WriteString(s string) (int, error) {
+	if _, err := w.size.WriteString(s); err != nil {
+		return 0, err
+	}
+	if w.capturing > 0 {
+		w.capture.WriteString(s)
+	}
+	return w.Writer.WriteString(s)
+}
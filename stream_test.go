@@ -0,0 +1,193 @@
+package gqldeduplicator
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeflateStream(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Given    string
+		Expected string
+		Deflated bool
+	}{
+		{
+			Name:     "should deflate duplicates",
+			Given:    `{"root":[{"__typename":"foo","id":1,"name":"foo","child":{"__typename":"bar","id":1,"name":"bar"}},{"__typename":"foo","id":2,"name":"foo","child":{"__typename":"bar","id":1,"name":"bar"}},{"__typename":"foo","id":1,"name":"foo","child":{"__typename":"bar","id":1,"name":"bar"}}]}`,
+			Expected: `{"root":[{"__typename":"foo","id":1,"name":"foo","child":{"__typename":"bar","id":1,"name":"bar"}},{"__typename":"foo","id":2,"name":"foo","child":{"__typename":"bar","id":1}},{"__typename":"foo","id":1}]}`,
+			Deflated: true,
+		},
+		{
+			Name:     "should deflate object with typename after nested object",
+			Given:    `{"root":[{"id":1,"child":{"id":1,"__typename":"bar"},"__typename":"foo"},{"id":1,"child":{"id":1,"__typename":"bar"},"__typename":"foo"}]}`,
+			Expected: `{"root":[{"id":1,"child":{"id":1,"__typename":"bar"},"__typename":"foo"},{"__typename":"foo","id":1}]}`,
+			Deflated: true,
+		},
+		{
+			Name:     "should not deflate duplicate with different selection",
+			Given:    `{"root":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"foo","age":1}]}`,
+			Expected: `{"root":[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"foo","age":1}]}`,
+		},
+		{
+			Name:     "should stream scalar and nested list",
+			Given:    ` [ [1, "a<b"], true, null, 1.50, {} ] `,
+			Expected: `[[1,"a\u003cb"],true,null,1.50,{}]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var w bytes.Buffer
+			result, err := DeflateStream(strings.NewReader(test.Given), &w)
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expected, w.String())
+			assert.Equal(t, test.Deflated, result.Deflated)
+			assert.Nil(t, result.Data)
+
+			deflated, err := Deflate([]byte(test.Given))
+			assert.NoError(t, err)
+			assert.JSONEq(t, string(deflated.Data), w.String())
+		})
+	}
+
+	t.Run("should report conflict", func(t *testing.T) {
+		var w bytes.Buffer
+		result, err := NewDeflater(WithConflictPolicy(ConflictKeepBoth)).DeflateStream(strings.NewReader(`[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"bar"}]`), &w)
+		assert.NoError(t, err)
+		assert.Equal(t, `[{"__typename":"foo","id":1,"name":"foo"},{"__typename":"foo","id":1,"name":"bar"}]`, w.String())
+		assert.Len(t, result.Conflicts, 1)
+	})
+
+	t.Run("should deflate global type identified before nested object", func(t *testing.T) {
+		given := `{"a":{"__typename":"User","id":1,"name":"foo","friend":{"__typename":"User","id":2,"name":"bar"}},` +
+			`"b":{"__typename":"User","id":1,"name":"foo","friend":{"__typename":"User","id":2,"name":"bar"}},` +
+			`"c":{"friend":{"__typename":"User","id":2,"name":"bar"},"__typename":"User","id":3}}`
+		expected := `{"a":{"__typename":"User","id":1,"name":"foo","friend":{"__typename":"User","id":2,"name":"bar"}},` +
+			`"b":{"__typename":"User","id":1},` +
+			`"c":{"friend":{"__typename":"User","id":2},"__typename":"User","id":3}}`
+
+		var w bytes.Buffer
+		result, err := NewDeflater(WithGlobalType("User")).DeflateStream(strings.NewReader(given), &w)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, w.String())
+		assert.Equal(t, 2, result.Stats.Stubs)
+
+		inflated, err := NewInflater(WithGlobalType("User"), WithUnresolvedPolicy(UnresolvedFail)).InflateStream(strings.NewReader(expected), &w)
+		assert.NoError(t, err)
+		assert.True(t, inflated.Inflated)
+	})
+
+	t.Run("should not deflate global type identified after nested object", func(t *testing.T) {
+		given := `{"a":{"__typename":"User","id":1,"friend":{"name":"foo"}},"b":{"friend":{"name":"foo"},"__typename":"User","id":1}}`
+
+		var w bytes.Buffer
+		_, err := NewDeflater(WithGlobalType("User")).DeflateStream(strings.NewReader(given), &w)
+		assert.NoError(t, err)
+		assert.Equal(t, given, w.String())
+	})
+
+	t.Run("should memoize global type in document order like Deflate", func(t *testing.T) {
+		for _, given := range []string{
+			`[{"__typename":"T","id":1,"a":{"__typename":"T","id":1,"b":1}},{"__typename":"T","id":1,"b":1}]`,
+			`[{"__typename":"T","id":1,"a":[{"__typename":"T","id":1,"b":1},{"__typename":"T","id":1,"b":1}]},{"__typename":"T","id":1,"b":1}]`,
+			`[{"a":{"__typename":"T","id":1,"b":1},"__typename":"T","id":1},{"__typename":"T","id":1,"b":1}]`,
+			`[{"__typename":"T","id":1,"a":{"__typename":"T","id":1,"b":1}},{"__typename":"T","id":1,"a":{"__typename":"T","id":1,"b":1}}]`,
+		} {
+			deflater, inflater := NewDeflater(WithGlobalType("T")), NewInflater(WithGlobalType("T"))
+			var w bytes.Buffer
+			_, err := deflater.DeflateStream(strings.NewReader(given), &w)
+			assert.NoError(t, err, given)
+
+			deflated, err := deflater.Deflate([]byte(given))
+			assert.NoError(t, err, given)
+			assert.JSONEq(t, string(deflated.Data), w.String(), given)
+
+			inflated, err := inflater.Inflate(w.Bytes())
+			assert.NoError(t, err, given)
+			assert.JSONEq(t, given, string(inflated.Data), given)
+		}
+	})
+
+	t.Run("should fail on global type identified after its nested duplicate is deflated", func(t *testing.T) {
+		given := `{"a":{"x":{"__typename":"T","id":1,"b":1},"y":{"__typename":"T","id":1,"b":1}},"__typename":"T","id":1}`
+
+		_, err := NewDeflater(WithGlobalType("T")).DeflateStream(strings.NewReader(given), &bytes.Buffer{})
+		assert.Equal(t, errUnorderedEntity, err)
+	})
+
+	t.Run("should return error on invalid json", func(t *testing.T) {
+		for _, given := range []string{``, `{`, `[{"a":1]`, `{} {}`} {
+			result, err := DeflateStream(strings.NewReader(given), &bytes.Buffer{})
+			assert.Error(t, err, given)
+			assert.Nil(t, result)
+		}
+	})
+}
+
+func TestInflateStream(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Given    string
+		Expected string
+		Inflated bool
+	}{
+		{
+			Name:     "should inflate stubs",
+			Given:    `{"root":[{"__typename":"foo","id":1,"name":"foo","child":{"__typename":"bar","id":1,"name":"bar"}},{"__typename":"foo","id":2,"name":"foo","child":{"__typename":"bar","id":1}},{"__typename":"foo","id":1}]}`,
+			Expected: `{"root":[{"__typename":"foo","id":1,"name":"foo","child":{"__typename":"bar","id":1,"name":"bar"}},{"__typename":"foo","id":2,"name":"foo","child":{"__typename":"bar","id":1,"name":"bar"}},{"__typename":"foo","id":1,"name":"foo","child":{"__typename":"bar","id":1,"name":"bar"}}]}`,
+			Inflated: true,
+		},
+		{
+			Name:     "should inflate object with typename after nested object",
+			Given:    `{"root":[{"id":1,"child":{"id":1,"__typename":"bar"},"name":"foo","__typename":"foo"},{"__typename":"foo","id":1}]}`,
+			Expected: `{"root":[{"id":1,"child":{"id":1,"__typename":"bar"},"name":"foo","__typename":"foo"},{"id":1,"child":{"id":1,"__typename":"bar"},"name":"foo","__typename":"foo"}]}`,
+			Inflated: true,
+		},
+		{
+			Name:     "should keep stub read before its full object",
+			Given:    `{"root":[{"__typename":"foo","id":1},{"__typename":"foo","id":1,"name":"foo"}]}`,
+			Expected: `{"root":[{"__typename":"foo","id":1},{"__typename":"foo","id":1,"name":"foo"}]}`,
+		},
+		{
+			Name:     "should stream scalar and nested list",
+			Given:    ` [ [1, "a<b"], true, null, 1.50, {} ] `,
+			Expected: `[[1,"a\u003cb"],true,null,1.50,{}]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var w bytes.Buffer
+			result, err := InflateStream(strings.NewReader(test.Given), &w)
+			assert.NoError(t, err)
+			assert.Equal(t, test.Expected, w.String())
+			assert.Equal(t, test.Inflated, result.Inflated)
+			assert.Nil(t, result.Data)
+		})
+	}
+
+	t.Run("should restore output of deflate stream", func(t *testing.T) {
+		given := `{"a":{"__typename":"foo","id":1,"x":1},"root":[{"items":[{"__typename":"foo","id":1,"x":1},{"__typename":"foo","id":1,"x":1}]},{"items":[{"__typename":"foo","id":1,"x":1}]}]}`
+
+		var deflated, inflated bytes.Buffer
+		_, err := DeflateStream(strings.NewReader(given), &deflated)
+		assert.NoError(t, err)
+		assert.NotEqual(t, given, deflated.String())
+
+		_, err = InflateStream(&deflated, &inflated)
+		assert.NoError(t, err)
+		assert.Equal(t, given, inflated.String())
+	})
+
+	t.Run("should return error on invalid json", func(t *testing.T) {
+		for _, given := range []string{``, `{`, `[{"a":1]`, `{} {}`} {
+			result, err := InflateStream(strings.NewReader(given), &bytes.Buffer{})
+			assert.Error(t, err, given)
+			assert.Nil(t, result)
+		}
+	})
+}